@@ -3,6 +3,7 @@
 package websocket
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/sha1"
 	"encoding/base64"
@@ -10,11 +11,13 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/textproto"
 	"net/url"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"nhooyr.io/websocket/internal/errd"
 )
@@ -26,6 +29,14 @@ type AcceptOptions struct {
 	// reject it, close the connection when c.Subprotocol() == "".
 	Subprotocols []string
 
+	// SelectSubprotocol, if set, is used instead of Subprotocols to choose the
+	// subprotocol from those offered by the client in order of preference.
+	//
+	// chosen must be one of offered or the empty string for no subprotocol,
+	// otherwise the handshake fails with http.StatusInternalServerError.
+	// If ok is false, the handshake is rejected with http.StatusBadRequest.
+	SelectSubprotocol func(offered []string) (chosen string, ok bool)
+
 	// InsecureSkipVerify is used to disable Accept's origin verification behaviour.
 	//
 	// You probably want to use OriginPatterns instead.
@@ -61,6 +72,169 @@ type AcceptOptions struct {
 	// Defaults to 512 bytes for CompressionNoContextTakeover and 128 bytes
 	// for CompressionContextTakeover.
 	CompressionThreshold int
+
+	// CompressionFallback makes Write send a message uncompressed if compressing
+	// it would not make it smaller, e.g. for already compressed data. The message
+	// is compressed into a buffer first to compare the sizes.
+	//
+	// It only applies to Write as a message streamed with Writer is compressed
+	// and written frame by frame. See Conn.Stats for how often it triggers.
+	CompressionFallback bool
+
+	// CompressionDictionary seeds the compression dictionary of every connection
+	// so that messages sharing a common prefix, e.g. a fixed JSON envelope,
+	// compress well from the very first message. Only the last 8192 bytes are
+	// used when compressing.
+	//
+	// Both peers must be configured with the same dictionary out of band as
+	// there is no way to negotiate it. A mismatched dictionary results in
+	// corrupt or failed decompression.
+	//
+	// With CompressionNoContextTakeover, every message starts from the dictionary.
+	CompressionDictionary []byte
+
+	// RequireCompression rejects the handshake with http.StatusBadRequest if
+	// the client does not offer permessage-deflate. As compression can never be
+	// negotiated with CompressionDisabled, every client is rejected in that mode.
+	//
+	// To never compress even when offered, use CompressionDisabled instead.
+	RequireCompression bool
+
+	// AllowLegacyDeflateFrame enables negotiating the non standard
+	// x-webkit-deflate-frame extension with clients that offer it but not
+	// permessage-deflate, e.g. very old versions of Safari. It compresses
+	// every frame separately instead of every message.
+	//
+	// CompressionMode and CompressionThreshold apply to it as they do to
+	// permessage-deflate.
+	//
+	// The extension allows a message to mix compressed and uncompressed
+	// frames but such messages are not supported and fail the connection
+	// with StatusProtocolError. Every frame of a message written is
+	// compressed or none are.
+	AllowLegacyDeflateFrame bool
+
+	// CloseHandshakeTimeout bounds both writing a close frame and waiting
+	// for the peer's close frame in reply during the close handshake.
+	//
+	// Defaults to 5s. A negative value disables the timeout so that only
+	// the connection closing bounds the close handshake.
+	CloseHandshakeTimeout time.Duration
+
+	// WriteQueueSize enables a bounded write queue when positive.
+	//
+	// Write will then copy the message into the queue and return immediately
+	// instead of waiting for it to be written. A single goroutine writes queued
+	// messages to the connection in order. If the queue is full, Write returns
+	// ErrWriteQueueFull. Errors writing a queued message close the connection.
+	//
+	// Close writes the messages still queued before the close frame. If that
+	// takes longer than CloseHandshakeTimeout, the messages still queued are
+	// dropped and never written.
+	//
+	// Writer is unaffected and still writes directly to the connection.
+	WriteQueueSize int
+
+	// ReadBufferSize and WriteBufferSize set the size of the buffers used to
+	// read from and write to the connection. Larger buffers reduce syscalls when
+	// streaming large messages while smaller buffers reduce memory usage.
+	//
+	// Both default to reusing the buffers from hijacking the connection which
+	// are 4096 bytes with net/http. ReadBufferSize has a minimum of 16 bytes.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// MaxFragments limits the number of frames a single message read from the
+	// peer may be fragmented into. A message exceeding it closes the connection
+	// with StatusProtocolError. This protects against fragmentation floods of
+	// tiny frames that stay within the read limit.
+	//
+	// Defaults to 0 which means unlimited.
+	MaxFragments int
+
+	// MaxWireFrameSize limits the payload length of a single data frame read
+	// from the peer as sent on the wire, i.e. before any decompression. A frame
+	// exceeding it closes the connection with StatusMessageTooBig before any of
+	// its payload is read.
+	//
+	// Unlike SetReadLimit which bounds the decompressed size of a message, this
+	// bounds the compressed size so the two can be tuned independently.
+	//
+	// Defaults to 0 which means unlimited.
+	MaxWireFrameSize int64
+
+	// OnWriteProgress and OnReadProgress are called with the total number of
+	// uncompressed bytes of the current message written or read so far, e.g.
+	// to render a progress bar when streaming a large message.
+	//
+	// OnWriteProgress is called once the data passed to Write, or to each Write
+	// of a Writer, has been written to the connection as frames. OnReadProgress
+	// is called after every read of the message that returns data.
+	//
+	// They are called without the frame locks held so pings and pongs are not
+	// held up but they block the write or read they report on until they return.
+	OnWriteProgress func(written int64)
+	OnReadProgress  func(read int64)
+
+	// OnMessageWritten is called after the fin frame of every data message
+	// written has been sent with the size of the message and the total payload
+	// size of its frames on the wire. They are equal unless the message was
+	// compressed, so comparing them shows whether compression is worthwhile,
+	// e.g. to tune CompressionThreshold.
+	OnMessageWritten func(typ MessageType, uncompressed, wire int)
+
+	// OnError is called once with the originating error when the connection
+	// fails, e.g. a write of a pong or close frame failing, a read timing out
+	// or the connection dropping, rather than being closed with a close handshake
+	// or a close frame from the peer. This lets the failure be logged as it
+	// happens instead of on the next Read or Write.
+	//
+	// It is called in a goroutine of its own so it may use the connection.
+	OnError func(err error)
+
+	// IdleTimeout closes the connection with StatusPolicyViolation if no frame,
+	// data or control, is received from the client within the timeout.
+	// The timer is reset on every received frame.
+	//
+	// As with Ping, frames are only received while the connection is being
+	// read from with Reader or CloseRead. A server that only writes is closed
+	// once the timeout passes even if the client is active, so use CloseRead
+	// if no data messages are expected from the client.
+	//
+	// Defaults to 0 which means no idle timeout.
+	IdleTimeout time.Duration
+
+	// MaxPingsPerSecond limits the rate at which pings from the client are
+	// answered with pongs. Bursts of up to MaxPingsPerSecond pings are allowed,
+	// after which pings are answered at the sustained rate.
+	//
+	// Pings beyond the limit are dropped without a pong unless ClosePingFlood
+	// is set in which case the connection is closed with StatusPolicyViolation.
+	//
+	// Defaults to 0 which means unlimited.
+	MaxPingsPerSecond int
+	ClosePingFlood    bool
+
+	// MaxConnectionAge closes the connection with StatusGoingAway once it has
+	// been open for the given duration regardless of activity, e.g. to force
+	// clients to reauthenticate.
+	//
+	// When the age is reached, a message being written is given up to
+	// MaxConnectionAgeGrace to complete before the connection is closed.
+	// No new messages can be started in the meantime.
+	//
+	// Defaults to 0 which means no maximum age.
+	MaxConnectionAge      time.Duration
+	MaxConnectionAgeGrace time.Duration
+
+	// NonUpgradeHandler, if set, serves requests that are not WebSocket upgrade
+	// requests at all, i.e. lack the Connection: Upgrade and Upgrade: websocket
+	// headers, such as a browser loading the endpoint as a page. Accept then
+	// returns an error wrapping ErrNonUpgradeRequest without writing anything
+	// to w itself.
+	//
+	// Upgrade requests that are invalid are still rejected by Accept.
+	NonUpgradeHandler http.Handler
 }
 
 // Accept accepts a WebSocket handshake from a client and upgrades the
@@ -70,6 +244,10 @@ type AcceptOptions struct {
 // See the InsecureSkipVerify and OriginPatterns options to allow cross origin requests.
 //
 // Accept will write a response to w on all errors.
+//
+// The handshake response has been flushed by the time Accept returns so
+// to reject an upgraded client, e.g. one that is not authorized for the
+// requested resource, call Close with the desired status immediately.
 func Accept(w http.ResponseWriter, r *http.Request, opts *AcceptOptions) (*Conn, error) {
 	return accept(w, r, opts)
 }
@@ -82,6 +260,11 @@ func accept(w http.ResponseWriter, r *http.Request, opts *AcceptOptions) (_ *Con
 	}
 	opts = &*opts
 
+	if opts.NonUpgradeHandler != nil && !isUpgradeRequest(r) {
+		opts.NonUpgradeHandler.ServeHTTP(w, r)
+		return nil, ErrNonUpgradeRequest
+	}
+
 	errCode, err := verifyClientRequest(w, r)
 	if err != nil {
 		http.Error(w, err.Error(), errCode)
@@ -100,6 +283,31 @@ func accept(w http.ResponseWriter, r *http.Request, opts *AcceptOptions) (_ *Con
 		}
 	}
 
+	var subproto string
+	if opts.SelectSubprotocol != nil {
+		offered := headerTokens(r.Header, "Sec-WebSocket-Protocol")
+		var ok bool
+		subproto, ok = opts.SelectSubprotocol(offered)
+		if !ok {
+			err = fmt.Errorf("no acceptable subprotocol offered: %q", offered)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil, err
+		}
+		if subproto != "" && !subprotocolOffered(offered, subproto) {
+			err = fmt.Errorf("SelectSubprotocol chose %q which was not offered: %q", subproto, offered)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return nil, err
+		}
+	} else {
+		subproto = selectSubprotocol(r, opts.Subprotocols)
+	}
+
+	if opts.RequireCompression && (opts.CompressionMode == CompressionDisabled || !offersCompression(r, opts.AllowLegacyDeflateFrame)) {
+		err = errors.New("client did not offer permessage-deflate but compression is required")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, err
+	}
+
 	hj, ok := w.(http.Hijacker)
 	if !ok {
 		err = errors.New("http.ResponseWriter does not implement http.Hijacker")
@@ -113,12 +321,11 @@ func accept(w http.ResponseWriter, r *http.Request, opts *AcceptOptions) (_ *Con
 	key := r.Header.Get("Sec-WebSocket-Key")
 	w.Header().Set("Sec-WebSocket-Accept", secWebSocketAccept(key))
 
-	subproto := selectSubprotocol(r, opts.Subprotocols)
 	if subproto != "" {
 		w.Header().Set("Sec-WebSocket-Protocol", subproto)
 	}
 
-	copts, err := acceptCompression(r, w, opts.CompressionMode)
+	copts, err := acceptCompression(r, w, opts.CompressionMode, opts.AllowLegacyDeflateFrame)
 	if err != nil {
 		return nil, err
 	}
@@ -138,22 +345,89 @@ func accept(w http.ResponseWriter, r *http.Request, opts *AcceptOptions) (_ *Con
 		return nil, err
 	}
 
+	return newServerConn(netConn, brw, w.Header().Get("Sec-WebSocket-Protocol"), w.Header().Get("Sec-WebSocket-Extensions"), copts, opts)
+}
+
+// NewServerConn creates a server side *Conn from a connection that has already
+// completed the WebSocket handshake, e.g. one upgraded manually.
+//
+// brw may be nil. Otherwise any bytes already buffered in brw.Reader, such as the
+// start of the first frame read by an HTTP server while hijacking, are consumed
+// before reading from netConn and brw.Writer is flushed before writing to netConn.
+// To pass leftover bytes from elsewhere, buffer them in brw.Reader with Peek first.
+//
+// subprotocol is the subprotocol negotiated during the handshake.
+// Compression is never enabled as it must be negotiated during the handshake,
+// so opts.CompressionMode is ignored.
+func NewServerConn(netConn net.Conn, brw *bufio.ReadWriter, subprotocol string, opts *AcceptOptions) (*Conn, error) {
+	if opts == nil {
+		opts = &AcceptOptions{}
+	}
+	if brw == nil {
+		brw = bufio.NewReadWriter(bufio.NewReader(netConn), bufio.NewWriter(netConn))
+	}
+	c, err := newServerConn(netConn, brw, subprotocol, "", nil, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create WebSocket connection: %w", err)
+	}
+	return c, nil
+}
+
+func newServerConn(netConn net.Conn, brw *bufio.ReadWriter, subprotocol, extensions string, copts *compressionOptions, opts *AcceptOptions) (*Conn, error) {
 	// https://github.com/golang/go/issues/32314
 	b, _ := brw.Reader.Peek(brw.Reader.Buffered())
-	brw.Reader.Reset(io.MultiReader(bytes.NewReader(b), netConn))
+	br := brw.Reader
+	if opts.ReadBufferSize > 0 {
+		br = bufio.NewReaderSize(nil, opts.ReadBufferSize)
+	}
+	br.Reset(io.MultiReader(bytes.NewReader(b), netConn))
+
+	bw := brw.Writer
+	if opts.WriteBufferSize > 0 {
+		// The switching protocols response may still be buffered.
+		err := bw.Flush()
+		if err != nil {
+			netConn.Close()
+			return nil, fmt.Errorf("failed to flush handshake response: %w", err)
+		}
+		bw = bufio.NewWriterSize(netConn, opts.WriteBufferSize)
+	}
 
 	return newConn(connConfig{
-		subprotocol:    w.Header().Get("Sec-WebSocket-Protocol"),
+		subprotocol:    subprotocol,
+		extensions:     extensions,
 		rwc:            netConn,
+		netConn:        netConn,
 		client:         false,
 		copts:          copts,
 		flateThreshold: opts.CompressionThreshold,
 
-		br: brw.Reader,
-		bw: brw.Writer,
+		br: br,
+		bw: bw,
+
+		closeHandshakeTimeout: opts.CloseHandshakeTimeout,
+		compressionFallback:   opts.CompressionFallback,
+		compressionDict:       opts.CompressionDictionary,
+		writeQueueSize:        opts.WriteQueueSize,
+		maxFragments:          opts.MaxFragments,
+		maxWireFrameSize:      opts.MaxWireFrameSize,
+		onWriteProgress:       opts.OnWriteProgress,
+		onReadProgress:        opts.OnReadProgress,
+		onMessageWritten:      opts.OnMessageWritten,
+		onError:               opts.OnError,
+		idleTimeout:           opts.IdleTimeout,
+		maxPingsPerSecond:     opts.MaxPingsPerSecond,
+		closePingFlood:        opts.ClosePingFlood,
+		maxConnectionAge:      opts.MaxConnectionAge,
+		maxConnectionAgeGrace: opts.MaxConnectionAgeGrace,
 	}), nil
 }
 
+func isUpgradeRequest(r *http.Request) bool {
+	return headerContainsToken(r.Header, "Connection", "Upgrade") &&
+		headerContainsToken(r.Header, "Upgrade", "websocket")
+}
+
 func verifyClientRequest(w http.ResponseWriter, r *http.Request) (errCode int, _ error) {
 	if !r.ProtoAtLeast(1, 1) {
 		return http.StatusUpgradeRequired, fmt.Errorf("WebSocket protocol violation: handshake request must be at least HTTP/1.1: %q", r.Proto)
@@ -230,23 +504,50 @@ func selectSubprotocol(r *http.Request, subprotocols []string) string {
 	return ""
 }
 
-func acceptCompression(r *http.Request, w http.ResponseWriter, mode CompressionMode) (*compressionOptions, error) {
+func subprotocolOffered(offered []string, subproto string) bool {
+	for _, cp := range offered {
+		if strings.EqualFold(subproto, cp) {
+			return true
+		}
+	}
+	return false
+}
+
+func acceptCompression(r *http.Request, w http.ResponseWriter, mode CompressionMode, allowLegacy bool) (*compressionOptions, error) {
 	if mode == CompressionDisabled {
 		return nil, nil
 	}
 
-	for _, ext := range websocketExtensions(r.Header) {
-		switch ext.name {
-		case "permessage-deflate":
+	exts := websocketExtensions(r.Header)
+	for _, ext := range exts {
+		if ext.name == "permessage-deflate" {
 			return acceptDeflate(w, ext, mode)
-			// Disabled for now, see https://github.com/nhooyr/websocket/issues/218
-			// case "x-webkit-deflate-frame":
-			// 	return acceptWebkitDeflate(w, ext, mode)
+		}
+	}
+	// Only used if permessage-deflate is not offered.
+	// See https://github.com/nhooyr/websocket/issues/218
+	if allowLegacy {
+		for _, ext := range exts {
+			if ext.name == "x-webkit-deflate-frame" {
+				return acceptWebkitDeflate(w, ext, mode)
+			}
 		}
 	}
 	return nil, nil
 }
 
+func offersCompression(r *http.Request, allowLegacy bool) bool {
+	for _, ext := range websocketExtensions(r.Header) {
+		switch {
+		case ext.name == "permessage-deflate":
+			return true
+		case ext.name == "x-webkit-deflate-frame" && allowLegacy:
+			return true
+		}
+	}
+	return false
+}
+
 func acceptDeflate(w http.ResponseWriter, ext websocketExtension, mode CompressionMode) (*compressionOptions, error) {
 	copts := mode.opts()
 
@@ -277,6 +578,7 @@ func acceptDeflate(w http.ResponseWriter, ext websocketExtension, mode Compressi
 
 func acceptWebkitDeflate(w http.ResponseWriter, ext websocketExtension, mode CompressionMode) (*compressionOptions, error) {
 	copts := mode.opts()
+	copts.deflateFrame = true
 	// The peer must explicitly request it.
 	copts.serverNoContextTakeover = false
 
@@ -3,15 +3,37 @@ package websocket
 import (
 	"errors"
 	"net/http"
+	"time"
 )
 
 // AcceptOptions represents Accept's options.
 type AcceptOptions struct {
-	Subprotocols         []string
-	InsecureSkipVerify   bool
-	OriginPatterns       []string
-	CompressionMode      CompressionMode
-	CompressionThreshold int
+	Subprotocols            []string
+	SelectSubprotocol       func(offered []string) (chosen string, ok bool)
+	InsecureSkipVerify      bool
+	OriginPatterns          []string
+	CompressionMode         CompressionMode
+	CompressionThreshold    int
+	CompressionFallback     bool
+	CompressionDictionary   []byte
+	RequireCompression      bool
+	AllowLegacyDeflateFrame bool
+	CloseHandshakeTimeout   time.Duration
+	WriteQueueSize          int
+	ReadBufferSize          int
+	WriteBufferSize         int
+	MaxFragments            int
+	MaxWireFrameSize        int64
+	OnWriteProgress         func(written int64)
+	OnReadProgress          func(read int64)
+	OnMessageWritten        func(typ MessageType, uncompressed, wire int)
+	OnError                 func(err error)
+	IdleTimeout             time.Duration
+	MaxPingsPerSecond       int
+	ClosePingFlood          bool
+	MaxConnectionAge        time.Duration
+	MaxConnectionAgeGrace   time.Duration
+	NonUpgradeHandler       http.Handler
 }
 
 // Accept is stubbed out for Wasm.
@@ -4,14 +4,19 @@ package websocket
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"errors"
+	"io"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"nhooyr.io/websocket/internal/test/assert"
+	"nhooyr.io/websocket/internal/xsync"
 )
 
 func TestAccept(t *testing.T) {
@@ -27,6 +32,38 @@ func TestAccept(t *testing.T) {
 		assert.Contains(t, err, "protocol violation")
 	})
 
+	t.Run("nonUpgradeHandler", func(t *testing.T) {
+		t.Parallel()
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+
+		_, err := Accept(w, r, &AcceptOptions{
+			NonUpgradeHandler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("hello"))
+			}),
+		})
+		assert.Equal(t, "err", true, errors.Is(err, ErrNonUpgradeRequest))
+		assert.Equal(t, "status", http.StatusOK, w.Code)
+		assert.Equal(t, "body", "hello", w.Body.String())
+		assert.Equal(t, "upgrade header", "", w.Header().Get("Upgrade"))
+	})
+
+	t.Run("nonUpgradeHandlerBadUpgrade", func(t *testing.T) {
+		t.Parallel()
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+
+		_, err := Accept(w, r, &AcceptOptions{
+			NonUpgradeHandler: http.NotFoundHandler(),
+		})
+		assert.Contains(t, err, "unsupported WebSocket protocol version")
+		assert.Equal(t, "status", http.StatusBadRequest, w.Code)
+	})
+
 	t.Run("badOrigin", func(t *testing.T) {
 		t.Parallel()
 
@@ -92,6 +129,176 @@ func TestAccept(t *testing.T) {
 		_, err := Accept(w, r, nil)
 		assert.Contains(t, err, `failed to hijack connection`)
 	})
+
+	t.Run("selectSubprotocol", func(t *testing.T) {
+		t.Parallel()
+
+		var offered []string
+		selectSubprotocol := func(ps []string) (string, bool) {
+			offered = ps
+			return ps[len(ps)-1], true
+		}
+
+		c1, c2 := net.Pipe()
+
+		rec := httptest.NewRecorder()
+		w := mockHijacker{
+			ResponseWriter: rec,
+			hijack: func() (net.Conn, *bufio.ReadWriter, error) {
+				return c1, bufio.NewReadWriter(bufio.NewReader(c1), bufio.NewWriter(c1)), nil
+			},
+		}
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Sec-WebSocket-Version", "13")
+		r.Header.Set("Sec-WebSocket-Key", "meow123")
+		r.Header.Set("Sec-WebSocket-Protocol", "echo, echo2")
+
+		c, err := Accept(w, r, &AcceptOptions{
+			Subprotocols:      []string{"echo"},
+			SelectSubprotocol: selectSubprotocol,
+		})
+		assert.Success(t, err)
+		defer func() {
+			c2.Close()
+			c.Close(StatusInternalError, "")
+		}()
+
+		assert.Equal(t, "offered", []string{"echo", "echo2"}, offered)
+		assert.Equal(t, "subprotocol", "echo2", c.Subprotocol())
+		assert.Equal(t, "response subprotocol", "echo2", rec.Header().Get("Sec-WebSocket-Protocol"))
+	})
+
+	t.Run("rejectSubprotocol", func(t *testing.T) {
+		t.Parallel()
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Sec-WebSocket-Version", "13")
+		r.Header.Set("Sec-WebSocket-Key", "meow123")
+		r.Header.Set("Sec-WebSocket-Protocol", "echo")
+
+		_, err := Accept(w, r, &AcceptOptions{
+			SelectSubprotocol: func([]string) (string, bool) {
+				return "", false
+			},
+		})
+		assert.Contains(t, err, "no acceptable subprotocol offered")
+		assert.Equal(t, "status code", http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("unofferedSubprotocol", func(t *testing.T) {
+		t.Parallel()
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Sec-WebSocket-Version", "13")
+		r.Header.Set("Sec-WebSocket-Key", "meow123")
+		r.Header.Set("Sec-WebSocket-Protocol", "echo")
+
+		_, err := Accept(w, r, &AcceptOptions{
+			SelectSubprotocol: func([]string) (string, bool) {
+				return "chat", true
+			},
+		})
+		assert.Contains(t, err, `SelectSubprotocol chose "chat" which was not offered`)
+		assert.Equal(t, "status code", http.StatusInternalServerError, w.Code)
+		assert.Equal(t, "response subprotocol", "", w.Header().Get("Sec-WebSocket-Protocol"))
+	})
+
+	t.Run("requireCompression", func(t *testing.T) {
+		t.Parallel()
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Sec-WebSocket-Version", "13")
+		r.Header.Set("Sec-WebSocket-Key", "meow123")
+
+		_, err := Accept(w, r, &AcceptOptions{
+			RequireCompression: true,
+		})
+		assert.Contains(t, err, "client did not offer permessage-deflate but compression is required")
+		assert.Equal(t, "status code", http.StatusBadRequest, w.Code)
+
+		// Offering permessage-deflate gets past the check to the hijack.
+		w2 := mockHijacker{
+			ResponseWriter: httptest.NewRecorder(),
+			hijack: func() (conn net.Conn, writer *bufio.ReadWriter, err error) {
+				return nil, nil, errors.New("haha")
+			},
+		}
+		r.Header.Set("Sec-WebSocket-Extensions", "permessage-deflate")
+		_, err = Accept(w2, r, &AcceptOptions{
+			RequireCompression: true,
+		})
+		assert.Contains(t, err, "failed to hijack connection")
+	})
+}
+
+func TestNewServerConn(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	// The first frame was already read from the connection by the caller.
+	var buf bytes.Buffer
+	h := header{
+		fin:           true,
+		opcode:        opText,
+		payloadLength: 5,
+		masked:        true,
+		maskKey:       0xdeadbeef,
+	}
+	bw := bufio.NewWriter(&buf)
+	err := writeFrameHeader(h, bw, make([]byte, 8))
+	assert.Success(t, err)
+	p := []byte("hello")
+	mask(h.maskKey, p)
+	bw.Write(p)
+	bw.Flush()
+
+	serverPipe, clientPipe := net.Pipe()
+	br := bufio.NewReader(io.MultiReader(&buf, serverPipe))
+	_, err = br.Peek(buf.Len())
+	assert.Success(t, err)
+
+	sc, err := NewServerConn(serverPipe, bufio.NewReadWriter(br, bufio.NewWriter(serverPipe)), "echo", nil)
+	assert.Success(t, err)
+	defer sc.Close(StatusInternalError, "")
+	assert.Equal(t, "subprotocol", "echo", sc.Subprotocol())
+
+	cc := newConn(connConfig{
+		rwc:    clientPipe,
+		client: true,
+		br:     getBufioReader(clientPipe),
+		bw:     getBufioWriter(clientPipe),
+	})
+	defer cc.Close(StatusInternalError, "")
+
+	_, b, err := sc.Read(ctx)
+	assert.Success(t, err)
+	assert.Equal(t, "buffered msg", "hello", string(b))
+
+	werr := xsync.Go(func() error {
+		return cc.Write(ctx, MessageText, []byte("world"))
+	})
+	_, b, err = sc.Read(ctx)
+	assert.Success(t, err)
+	assert.Equal(t, "msg", "world", string(b))
+	assert.Success(t, <-werr)
+
+	cc.CloseRead(ctx)
+	err = sc.Close(StatusNormalClosure, "")
+	assert.Success(t, err)
 }
 
 func Test_verifyClientHandshake(t *testing.T) {
@@ -327,6 +534,7 @@ func Test_acceptCompression(t *testing.T) {
 		mode                       CompressionMode
 		reqSecWebSocketExtensions  string
 		respSecWebSocketExtensions string
+		allowLegacy                bool
 		expCopts                   *compressionOptions
 		error                      bool
 	}{
@@ -356,22 +564,42 @@ func Test_acceptCompression(t *testing.T) {
 			reqSecWebSocketExtensions: "permessage-deflate; meow",
 			error:                     true,
 		},
-		// {
-		// 	name:                       "x-webkit-deflate-frame",
-		// 	mode:                       CompressionNoContextTakeover,
-		// 	reqSecWebSocketExtensions:  "x-webkit-deflate-frame; no_context_takeover",
-		// 	respSecWebSocketExtensions: "x-webkit-deflate-frame; no_context_takeover",
-		// 	expCopts: &compressionOptions{
-		// 		clientNoContextTakeover: true,
-		// 		serverNoContextTakeover: true,
-		// 	},
-		// },
-		// {
-		// 	name:                      "x-webkit-deflate/error",
-		// 	mode:                      CompressionNoContextTakeover,
-		// 	reqSecWebSocketExtensions: "x-webkit-deflate-frame; max_window_bits",
-		// 	error:                     true,
-		// },
+		{
+			name:                       "x-webkit-deflate-frame",
+			mode:                       CompressionNoContextTakeover,
+			allowLegacy:                true,
+			reqSecWebSocketExtensions:  "x-webkit-deflate-frame; no_context_takeover",
+			respSecWebSocketExtensions: "x-webkit-deflate-frame; no_context_takeover",
+			expCopts: &compressionOptions{
+				clientNoContextTakeover: true,
+				serverNoContextTakeover: true,
+				deflateFrame:            true,
+			},
+		},
+		{
+			name:                      "x-webkit-deflate-frame/error",
+			mode:                      CompressionNoContextTakeover,
+			allowLegacy:               true,
+			reqSecWebSocketExtensions: "x-webkit-deflate-frame; max_window_bits",
+			error:                     true,
+		},
+		{
+			name:                      "x-webkit-deflate-frame/notAllowed",
+			mode:                      CompressionNoContextTakeover,
+			reqSecWebSocketExtensions: "x-webkit-deflate-frame; no_context_takeover",
+			expCopts:                  nil,
+		},
+		{
+			name:                       "x-webkit-deflate-frame/preferPermessageDeflate",
+			mode:                       CompressionNoContextTakeover,
+			allowLegacy:                true,
+			reqSecWebSocketExtensions:  "x-webkit-deflate-frame, permessage-deflate",
+			respSecWebSocketExtensions: "permessage-deflate; client_no_context_takeover; server_no_context_takeover",
+			expCopts: &compressionOptions{
+				clientNoContextTakeover: true,
+				serverNoContextTakeover: true,
+			},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -383,7 +611,7 @@ func Test_acceptCompression(t *testing.T) {
 			r.Header.Set("Sec-WebSocket-Extensions", tc.reqSecWebSocketExtensions)
 
 			w := httptest.NewRecorder()
-			copts, err := acceptCompression(r, w, tc.mode)
+			copts, err := acceptCompression(r, w, tc.mode, tc.allowLegacy)
 			if tc.error {
 				assert.Error(t, err)
 				return
@@ -30,9 +30,9 @@ const (
 	// a status code.
 	StatusNoStatusRcvd StatusCode = 1005
 
-	// StatusAbnormalClosure is exported for use only with Wasm.
-	// In non Wasm Go, the returned error will indicate whether the
-	// connection was closed abnormally.
+	// StatusAbnormalClosure is never sent on the wire. It is returned
+	// by CloseStatus when the connection was lost without a close frame
+	// being received, e.g. the peer's TCP connection dropped.
 	StatusAbnormalClosure StatusCode = 1006
 
 	StatusInvalidFramePayloadData StatusCode = 1007
@@ -53,7 +53,7 @@ const (
 // CloseError is returned when the connection is closed with a status and reason.
 //
 // Use Go 1.13's errors.As to check for this error.
-// Also see the CloseStatus helper.
+// Also see the CloseStatus and CloseReason helpers.
 type CloseError struct {
 	Code   StatusCode
 	Reason string
@@ -74,3 +74,15 @@ func CloseStatus(err error) StatusCode {
 	}
 	return -1
 }
+
+// CloseReason is like CloseStatus but also returns the reason from the
+// CloseError.
+//
+// ok will be false if the passed error is nil or not a CloseError.
+func CloseReason(err error) (code StatusCode, reason string, ok bool) {
+	var ce CloseError
+	if errors.As(err, &ce) {
+		return ce.Code, ce.Reason, true
+	}
+	return -1, "", false
+}
@@ -3,27 +3,41 @@
 package websocket
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"log"
-	"time"
+	"net"
 
 	"nhooyr.io/websocket/internal/errd"
 )
 
 // Close performs the WebSocket close handshake with the given status code and reason.
 //
-// It will write a WebSocket close frame with a timeout of 5s and then wait 5s for
-// the peer to send a close frame.
+// It will write a WebSocket close frame and then wait for the peer to send a close frame.
+// Each step is bounded by the CloseHandshakeTimeout option which defaults to 5s.
 // All data messages received from the peer during the close handshake will be discarded.
 //
 // The connection can only be closed once. Additional calls to Close
 // are no-ops.
 //
-// The maximum length of reason must be 125 bytes. Avoid
-// sending a dynamic reason.
+// The maximum length of reason is 123 bytes as the close frame payload
+// cannot exceed 125 bytes including the status code. Avoid sending a
+// dynamic reason.
+//
+// The codes RFC 6455 reserves from being sent, such as StatusAbnormalClosure
+// and StatusTLSHandshake, codes below 1000 and codes outside of the ranges
+// defined by the protocol or reserved for applications are invalid. An invalid
+// code or a reason that is too long returns an error without anything being
+// written, so the connection remains open and Close may be called again.
+//
+// To send a close frame without any payload, pass StatusNoStatusRcvd and an
+// empty reason. Any other code is sent as a 2 byte status code followed by
+// the reason, even if the reason is empty. Likewise, a close frame without a
+// payload from the peer is reported as StatusNoStatusRcvd.
 //
 // Close will unblock all goroutines interacting with the connection once
 // complete.
@@ -34,6 +48,22 @@ func (c *Conn) Close(code StatusCode, reason string) error {
 func (c *Conn) closeHandshake(code StatusCode, reason string) (err error) {
 	defer errd.Wrap(&err, "failed to close WebSocket")
 
+	if code != StatusNoStatusRcvd || reason != "" {
+		_, err = CloseError{Code: code, Reason: reason}.bytesErr()
+		if err != nil {
+			return fmt.Errorf("failed to marshal close frame: %w", err)
+		}
+	}
+
+	// Queued messages must go out before the close frame. Any still queued
+	// after the close handshake timeout are dropped.
+	ctx, cancel := c.withCloseHandshakeTimeout(context.Background())
+	err = c.flushWriteQueue(ctx)
+	cancel()
+	if err != nil {
+		c.dropWriteQueue()
+	}
+
 	writeErr := c.writeClose(code, reason)
 	closeHandshakeErr := c.waitCloseHandshake()
 
@@ -41,13 +71,90 @@ func (c *Conn) closeHandshake(code StatusCode, reason string) (err error) {
 		return writeErr
 	}
 
-	if CloseStatus(closeHandshakeErr) == -1 {
+	switch CloseStatus(closeHandshakeErr) {
+	case -1, StatusAbnormalClosure:
 		return closeHandshakeErr
 	}
 
 	return nil
 }
 
+// CloseHandshakeOnly performs the close handshake with StatusNormalClosure like
+// Close but then hands the underlying net.Conn over to the caller instead of
+// closing it, e.g. to speak a different protocol on it afterwards.
+//
+// Once it returns, the close frames have been exchanged, nothing more will be
+// read from or written to the net.Conn by the *websocket.Conn and no deadlines
+// have been set on it. Any bytes the peer sent after its close frame that were
+// already buffered are returned by the first reads from the returned net.Conn.
+//
+// ctx bounds the close handshake along with the CloseHandshakeTimeout option.
+// On error, the net.Conn is closed.
+//
+// It is only supported for connections from Accept and DialOnConn. Dial reads
+// through net/http's response body which may have buffered bytes past the
+// handshake that cannot be recovered, so connections from Dial are rejected
+// even though NetConn returns their net.Conn.
+func (c *Conn) CloseHandshakeOnly(ctx context.Context) (_ net.Conn, err error) {
+	defer errd.Wrap(&err, "failed to perform close handshake only")
+
+	if c.netConn == nil || c.rwc != io.ReadWriteCloser(c.netConn) {
+		return nil, errors.New("underlying connection is not read directly from its net.Conn")
+	}
+
+	c.closeMu.Lock()
+	if c.wroteClose || c.isClosed() {
+		c.closeMu.Unlock()
+		return nil, errors.New("connection already closed")
+	}
+	c.keepNetConn = true
+	c.closeMu.Unlock()
+
+	done := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-done:
+		case <-ctx.Done():
+			c.closeMu.Lock()
+			c.keepNetConn = false
+			c.closeMu.Unlock()
+			c.close(fmt.Errorf("close handshake: %w", ctx.Err()))
+		}
+	}()
+
+	err = c.closeHandshake(StatusNormalClosure, "")
+	close(done)
+	<-exited
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		c.netConn.Close()
+		return nil, err
+	}
+
+	if len(c.unread) == 0 {
+		return c.netConn, nil
+	}
+	return &unreadNetConn{
+		Conn: c.netConn,
+		r:    io.MultiReader(bytes.NewReader(c.unread), c.netConn),
+	}, nil
+}
+
+// unreadNetConn returns bytes buffered past the peer's close frame
+// before reading from the net.Conn.
+type unreadNetConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *unreadNetConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
 var errAlreadyWroteClose = errors.New("already wrote close")
 
 func (c *Conn) writeClose(code StatusCode, reason string) error {
@@ -74,7 +181,7 @@ func (c *Conn) writeClose(code StatusCode, reason string) error {
 	}
 
 	writeErr := c.writeControl(context.Background(), opClose, p)
-	if CloseStatus(writeErr) != -1 {
+	if s := CloseStatus(writeErr); s != -1 && s != StatusAbnormalClosure {
 		// Not a real error if it's due to a close frame being received.
 		writeErr = nil
 	}
@@ -88,34 +195,52 @@ func (c *Conn) writeClose(code StatusCode, reason string) error {
 	return writeErr
 }
 
-func (c *Conn) waitCloseHandshake() error {
+func (c *Conn) waitCloseHandshake() (err error) {
 	defer c.close(nil)
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	ctx, cancel := c.withCloseHandshakeTimeout(context.Background())
 	defer cancel()
 
-	err := c.readMu.lock(ctx)
+	err = c.readMu.lock(ctx)
 	if err != nil {
 		return err
 	}
 	defer c.readMu.unlock()
+	defer func() {
+		c.closeMu.Lock()
+		defer c.closeMu.Unlock()
+		if c.keepNetConn && CloseStatus(err) != -1 {
+			// Copied as c.br may be pooled on close.
+			b, _ := c.br.Peek(c.br.Buffered())
+			c.unread = append([]byte(nil), b...)
+		}
+	}()
 
 	if c.readCloseFrameErr != nil {
 		return c.readCloseFrameErr
 	}
 
+	// Discard the unread payload of any data frame we stopped reading
+	// midway, e.g. in CloseRead, so the next frame header can be read.
+	n := c.msgReader.payloadLength
+	c.msgReader.payloadLength = 0
+	if c.nextHeader != nil {
+		n = c.nextHeader.payloadLength
+		c.nextHeader = nil
+	}
 	for {
-		h, err := c.readLoop(ctx)
-		if err != nil {
-			return err
-		}
-
-		for i := int64(0); i < h.payloadLength; i++ {
+		for i := int64(0); i < n; i++ {
 			_, err := c.br.ReadByte()
 			if err != nil {
 				return err
 			}
 		}
+
+		h, err := c.readLoop(ctx)
+		if err != nil {
+			return err
+		}
+		n = h.payloadLength
 	}
 }
 
@@ -3,10 +3,18 @@
 package websocket
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
 	"io"
 	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"nhooyr.io/websocket/internal/test/assert"
 )
@@ -205,3 +213,254 @@ func TestCloseStatus(t *testing.T) {
 		})
 	}
 }
+
+func TestCloseReason(t *testing.T) {
+	t.Parallel()
+
+	code, reason, ok := CloseReason(io.EOF)
+	assert.Equal(t, "ok", false, ok)
+	assert.Equal(t, "code", StatusCode(-1), code)
+	assert.Equal(t, "reason", "", reason)
+
+	err := fmt.Errorf("failed to read: %w", CloseError{
+		Code:   StatusGoingAway,
+		Reason: "shutting down",
+	})
+	code, reason, ok = CloseReason(err)
+	assert.Equal(t, "ok", true, ok)
+	assert.Equal(t, "code", StatusGoingAway, code)
+	assert.Equal(t, "reason", "shutting down", reason)
+}
+
+func TestCloseWire(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name   string
+		code   StatusCode
+		reason string
+		exp    []byte
+	}{
+		{
+			name: "noStatus",
+			code: StatusNoStatusRcvd,
+			exp:  []byte{},
+		},
+		{
+			name: "emptyReason",
+			code: StatusNormalClosure,
+			exp:  []byte{0x03, 0xe8},
+		},
+		{
+			name:   "reason",
+			code:   StatusGoingAway,
+			reason: "bye",
+			exp:    []byte{0x03, 0xe9, 'b', 'y', 'e'},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			rp, c := newRawPeer(t, nil)
+			defer rp.nc.Close()
+
+			errc := make(chan error, 1)
+			go func() {
+				errc <- c.Close(tc.code, tc.reason)
+			}()
+
+			h, p := rp.readFrame()
+			assert.Equal(t, "opcode", opClose, h.opcode)
+			assert.Equal(t, "payload", tc.exp, p)
+
+			rp.writeFrame(header{fin: true, opcode: opClose}, nil)
+			assert.Success(t, <-errc)
+		})
+	}
+
+	t.Run("readEmpty", func(t *testing.T) {
+		t.Parallel()
+
+		rp, c := newRawPeer(t, nil)
+		defer rp.nc.Close()
+
+		go rp.writeFrame(header{fin: true, opcode: opClose}, nil)
+
+		errc := make(chan error, 1)
+		go func() {
+			_, _, err := c.Reader(context.Background())
+			errc <- err
+		}()
+
+		// The close frame is echoed back without a payload.
+		h, p := rp.readFrame()
+		assert.Equal(t, "opcode", opClose, h.opcode)
+		assert.Equal(t, "payload", []byte{}, p)
+
+		err := <-errc
+		assert.Equal(t, "close status", StatusNoStatusRcvd, CloseStatus(err))
+	})
+}
+
+func TestCloseInvalid(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name   string
+		code   StatusCode
+		reason string
+		err    string
+	}{
+		{name: "0", code: 0, err: "status code StatusCode(0) cannot be set"},
+		{name: "999", code: 999, err: "status code StatusCode(999) cannot be set"},
+		{name: "1004", code: statusReserved, err: "status code statusReserved cannot be set"},
+		{name: "1005", code: StatusNoStatusRcvd, reason: "bye", err: "status code StatusNoStatusRcvd cannot be set"},
+		{name: "1006", code: StatusAbnormalClosure, err: "status code StatusAbnormalClosure cannot be set"},
+		{name: "1015", code: StatusTLSHandshake, err: "status code StatusTLSHandshake cannot be set"},
+		{name: "1016", code: 1016, err: "status code StatusCode(1016) cannot be set"},
+		{name: "2999", code: 2999, err: "status code StatusCode(2999) cannot be set"},
+		{name: "5000", code: 5000, err: "status code StatusCode(5000) cannot be set"},
+		{name: "longReason", code: StatusNormalClosure, reason: strings.Repeat("x", 124), err: "reason string max is 123"},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			rp, c := newRawPeer(t, nil)
+			defer rp.nc.Close()
+
+			err := c.Close(tc.code, tc.reason)
+			assert.Contains(t, err, "failed to marshal close frame: "+tc.err)
+
+			// Nothing was written so the connection can still be closed.
+			reason := strings.Repeat("x", 123)
+			errc := make(chan error, 1)
+			go func() {
+				errc <- c.Close(StatusNormalClosure, reason)
+			}()
+
+			h, p := rp.readFrame()
+			assert.Equal(t, "opcode", opClose, h.opcode)
+			assert.Equal(t, "payload", append([]byte{0x03, 0xe8}, reason...), p)
+
+			rp.writeFrame(header{fin: true, opcode: opClose}, nil)
+			assert.Success(t, <-errc)
+		})
+	}
+}
+
+func TestCloseHandshakeOnly(t *testing.T) {
+	t.Parallel()
+
+	t.Run("success", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		rp, c := newRawPeer(t, nil)
+		defer rp.nc.Close()
+
+		type result struct {
+			nc  net.Conn
+			err error
+		}
+		resc := make(chan result, 1)
+		go func() {
+			nc, err := c.CloseHandshakeOnly(ctx)
+			resc <- result{nc, err}
+		}()
+
+		h, p := rp.readFrame()
+		assert.Equal(t, "opcode", opClose, h.opcode)
+		assert.Equal(t, "payload", []byte{0x03, 0xe8}, p)
+
+		// The bytes after the close frame are written along with it
+		// so that they are buffered by the Conn.
+		b := &bytes.Buffer{}
+		bw := bufio.NewWriter(b)
+		err := writeFrameHeader(header{fin: true, opcode: opClose, masked: true}, bw, make([]byte, 8))
+		assert.Success(t, err)
+		bw.WriteString("hello")
+		err = bw.Flush()
+		assert.Success(t, err)
+		go rp.nc.Write(b.Bytes())
+
+		res := <-resc
+		assert.Success(t, res.err)
+		defer res.nc.Close()
+
+		go rp.nc.Write([]byte(" world"))
+		buf := make([]byte, len("hello world"))
+		_, err = io.ReadFull(res.nc, buf)
+		assert.Success(t, err)
+		assert.Equal(t, "read", "hello world", string(buf))
+
+		// The net.Conn is still open for writing too.
+		go res.nc.Write([]byte("hi"))
+		buf = make([]byte, 2)
+		_, err = io.ReadFull(rp.br, buf)
+		assert.Success(t, err)
+		assert.Equal(t, "written", "hi", string(buf))
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+		defer cancel()
+
+		rp, c := newRawPeer(t, nil)
+		defer rp.nc.Close()
+
+		errc := make(chan error, 1)
+		go func() {
+			_, err := c.CloseHandshakeOnly(ctx)
+			errc <- err
+		}()
+
+		h, _ := rp.readFrame()
+		assert.Equal(t, "opcode", opClose, h.opcode)
+
+		// The peer never replies so the net.Conn is closed.
+		err := <-errc
+		assert.Error(t, err)
+		_, err = rp.br.ReadByte()
+		assert.Equal(t, "read err", io.EOF, err)
+	})
+
+	t.Run("dial", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c, err := Accept(w, r, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer c.Close(StatusInternalError, "")
+			c.Read(r.Context())
+		}))
+		defer s.Close()
+
+		c, _, err := Dial(ctx, s.URL, nil)
+		assert.Success(t, err)
+		defer c.Close(StatusInternalError, "")
+
+		_, err = c.CloseHandshakeOnly(ctx)
+		assert.Contains(t, err, "not read directly from its net.Conn")
+		// The connection is left untouched.
+		assert.Equal(t, "closed", false, c.isClosed())
+
+		err = c.Close(StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+}
@@ -20,6 +20,10 @@ func (m CompressionMode) opts() *compressionOptions {
 type compressionOptions struct {
 	clientNoContextTakeover bool
 	serverNoContextTakeover bool
+
+	// deflateFrame is set for the legacy x-webkit-deflate-frame extension
+	// which compresses every frame separately.
+	deflateFrame bool
 }
 
 func (copts *compressionOptions) setHeader(h http.Header) {
@@ -108,6 +112,11 @@ func putFlateReader(fr io.Reader) {
 	flateReaderPool.Put(fr)
 }
 
+// slidingWindow holds the last bytes of the stream used as the flate dictionary.
+//
+// Its buffer is taken from a pool of buffers of the same size on init and returned
+// to the pool on close. With context takeover close is only called once the connection
+// is closed so the dictionary lives for the whole session.
 type slidingWindow struct {
 	buf []byte
 }
@@ -123,16 +132,22 @@ func slidingWindowPool(n int) *sync.Pool {
 		return p
 	}
 
-	p = &sync.Pool{}
-
 	swPoolMu.Lock()
-	swPool[n] = p
-	swPoolMu.Unlock()
+	defer swPoolMu.Unlock()
 
+	// Another goroutine may have created the pool while we
+	// were waiting for the lock.
+	p, ok = swPool[n]
+	if !ok {
+		p = &sync.Pool{}
+		swPool[n] = p
+	}
 	return p
 }
 
-func (sw *slidingWindow) init(n int) {
+// init allocates the window if it has not already been and fills it with
+// the end of seed.
+func (sw *slidingWindow) init(n int, seed []byte) {
 	if sw.buf != nil {
 		return
 	}
@@ -144,10 +159,14 @@ func (sw *slidingWindow) init(n int) {
 	p := slidingWindowPool(n)
 	buf, ok := p.Get().([]byte)
 	if ok {
+		// A pooled buffer may hold another connection's data but the window
+		// only ever reads buf[:len(buf)] which write fully overwrites so
+		// nothing leaks into this connection's dictionary.
 		sw.buf = buf[:0]
 	} else {
 		sw.buf = make([]byte, 0, n)
 	}
+	sw.write(seed)
 }
 
 func (sw *slidingWindow) close() {
@@ -155,9 +174,7 @@ func (sw *slidingWindow) close() {
 		return
 	}
 
-	swPoolMu.Lock()
-	swPool[cap(sw.buf)].Put(sw.buf)
-	swPoolMu.Unlock()
+	slidingWindowPool(cap(sw.buf)).Put(sw.buf)
 	sw.buf = nil
 }
 
@@ -22,7 +22,7 @@ func Test_slidingWindow(t *testing.T) {
 			input := xrand.String(maxWindow)
 			windowLength := xrand.Int(maxWindow)
 			var sw slidingWindow
-			sw.init(windowLength)
+			sw.init(windowLength, nil)
 			sw.write([]byte(input))
 
 			assert.Equal(t, "window length", windowLength, cap(sw.buf))
@@ -32,3 +32,24 @@ func Test_slidingWindow(t *testing.T) {
 		})
 	}
 }
+
+func Test_slidingWindowPool(t *testing.T) {
+	t.Parallel()
+
+	const n = 4242
+
+	var sw slidingWindow
+	sw.init(n, nil)
+	sw.write([]byte(xrand.String(n)))
+	sw.close()
+	assert.Equal(t, "closed buf", []byte(nil), sw.buf)
+
+	// A reused buffer must start out empty.
+	sw.init(n, nil)
+	assert.Equal(t, "window length", n, cap(sw.buf))
+	assert.Equal(t, "reused buf", 0, len(sw.buf))
+
+	sw.write([]byte("hello"))
+	assert.Equal(t, "window", "hello", string(sw.buf))
+	sw.close()
+}
@@ -1,5 +1,13 @@
 package websocket
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
 // MessageType represents the type of a WebSocket message.
 // See https://tools.ietf.org/html/rfc6455#section-5.6
 type MessageType int
@@ -11,3 +19,120 @@ const (
 	// MessageBinary is for binary messages like protobufs.
 	MessageBinary
 )
+
+// BufferTooSmallError is returned by ReadInto when a message
+// does not fit in the passed buffer.
+type BufferTooSmallError struct {
+	// Size is the size of the message in bytes.
+	Size int64
+}
+
+func (e BufferTooSmallError) Error() string {
+	return fmt.Sprintf("buffer too small for message of %v bytes", e.Size)
+}
+
+// ErrSkipPong may be returned by a ping handler registered with SetPingHandler
+// to prevent the automatic pong reply.
+var ErrSkipPong = errors.New("skip pong")
+
+// ErrReadLimitExceeded is wrapped by the error returned when reading a message
+// larger than the limit set with SetReadLimit.
+var ErrReadLimitExceeded = errors.New("message exceeds read limit")
+
+// ErrNonUpgradeRequest is wrapped by the error returned by Accept when the
+// request was not a WebSocket upgrade and AcceptOptions.NonUpgradeHandler
+// served it instead.
+var ErrNonUpgradeRequest = errors.New("request is not a WebSocket upgrade")
+
+// Context returns a context that is cancelled once the connection is closed
+// for any reason. Use it to stop goroutines tied to the connection or to derive
+// contexts for per connection work.
+//
+// On Go 1.20 and later, context.Cause returns the error the connection was
+// closed with, CloseStatus on it returns the close status if there was one.
+func (c *Conn) Context() context.Context {
+	return c.ctx
+}
+
+// ReadBlocking is like Read but without a context. It blocks until a message
+// is read or the connection is closed.
+//
+// It is meant for quick scripts. Long running programs should use Read
+// so that reads can be cancelled.
+func (c *Conn) ReadBlocking() (MessageType, []byte, error) {
+	return c.Read(context.Background())
+}
+
+// WriteBlocking is like Write but without a context. It blocks until the
+// message is written or the connection is closed.
+//
+// It is meant for quick scripts. Long running programs should use Write
+// so that writes can be cancelled.
+func (c *Conn) WriteBlocking(typ MessageType, p []byte) error {
+	return c.Write(context.Background(), typ, p)
+}
+
+// Exchange writes req as a message of type typ and then reads the next data
+// message as the reply. Control frames received in between are handled as
+// usual.
+//
+// If the peer closes the connection before replying, the returned error
+// carries the close status, see CloseStatus.
+//
+// Exchange does not match replies to requests so concurrent calls must be
+// serialized by the caller.
+func (c *Conn) Exchange(ctx context.Context, typ MessageType, req []byte) (MessageType, []byte, error) {
+	err := c.Write(ctx, typ, req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to write request: %w", err)
+	}
+
+	typ, resp, err := c.Read(ctx)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read reply: %w", err)
+	}
+	return typ, resp, nil
+}
+
+// Broadcast writes p as a message of type typ to every connection in conns
+// concurrently so that a slow connection does not hold up the others.
+//
+// ctx bounds the whole broadcast. If timeout is positive, each write is also
+// bounded by its own timeout from when Broadcast is called so that connections
+// that do not keep up are given up on separately. As with Write, a connection
+// that fails to write the message in time is closed.
+//
+// The same p is written to every connection and must not be modified until
+// Broadcast returns. Each connection still compresses it separately if
+// compression was negotiated as its dictionary depends on its own history.
+//
+// The returned slice holds the error for the connection at the same index
+// in conns, nil if the message was written. nil entries in conns are skipped
+// with an error.
+func Broadcast(ctx context.Context, conns []*Conn, typ MessageType, p []byte, timeout time.Duration) []error {
+	errs := make([]error, len(conns))
+
+	var wg sync.WaitGroup
+	for i, c := range conns {
+		if c == nil {
+			errs[i] = errors.New("failed to broadcast: nil connection")
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, c *Conn) {
+			defer wg.Done()
+
+			ctx := ctx
+			if timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+			errs[i] = c.Write(ctx, typ, p)
+		}(i, c)
+	}
+	wg.Wait()
+
+	return errs
+}
@@ -8,10 +8,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"runtime"
 	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
+
+	"nhooyr.io/websocket/internal/xsync"
 )
 
 // Conn represents a WebSocket connection.
@@ -23,17 +27,36 @@ import (
 // Be sure to call Close on the connection when you
 // are finished with it to release associated resources.
 //
-// On any error from any method, the connection is closed
-// with an appropriate reason.
+// Errors reading from the connection close it with an appropriate reason.
+// Errors writing close it only if part of the message being written had
+// already gone out, as the message can then no longer be completed, or if the
+// message is compressed. A write that fails before its frame was started, e.g.
+// because its context expired while waiting for another write or because the
+// write queue is full, leaves the connection usable. So does an invalid
+// argument such as an invalid status code passed to Close.
 type Conn struct {
 	subprotocol    string
+	extensions     string
 	rwc            io.ReadWriteCloser
+	netConn        net.Conn
 	client         bool
+	disableMasking bool
 	copts          *compressionOptions
 	flateThreshold int
 	br             *bufio.Reader
 	bw             *bufio.Writer
 
+	compressionFallback  bool
+	compressionFallbacks xsync.Int64
+	compressionDict      []byte
+
+	closeHandshakeTimeout time.Duration
+
+	onWriteProgress  func(written int64)
+	onReadProgress   func(read int64)
+	onError          func(err error)
+	onMessageWritten func(typ MessageType, uncompressed, wire int)
+
 	readTimeout  chan context.Context
 	writeTimeout chan context.Context
 
@@ -43,6 +66,20 @@ type Conn struct {
 	readControlBuf    [maxControlPayload]byte
 	msgReader         *msgReader
 	readCloseFrameErr error
+	isReadClosed      xsync.Int64
+	maxFragments      int
+	maxWireFrameSize  int64
+	idleTimeout       time.Duration
+	idleTimer         *time.Timer
+	pingLimiter       *pingLimiter
+	closePingFlood    bool
+
+	// nextHeader is the header of the next data message read by
+	// NextMessageType for reader to start the message with.
+	nextHeader *header
+
+	maxConnectionAgeGrace time.Duration
+	ageTimer              *time.Timer
 
 	// Write state.
 	msgWriterState *msgWriterState
@@ -50,44 +87,107 @@ type Conn struct {
 	writeBuf       []byte
 	writeHeaderBuf [8]byte
 	writeHeader    header
+	writeQueue     chan queuedMsg
 
 	closed     chan struct{}
 	closeMu    sync.Mutex
 	closeErr   error
 	wroteClose bool
 
+	// ctx is returned by Context and cancelled with closeErr on close.
+	ctx       context.Context
+	cancelCtx func(error)
+
+	// keepNetConn is set by CloseHandshakeOnly to leave the underlying
+	// connection open on close. unread holds the bytes read from it past
+	// the peer's close frame.
+	keepNetConn bool
+	unread      []byte
+
 	pingCounter   int32
 	activePingsMu sync.Mutex
-	activePings   map[string]chan<- struct{}
+	activePings   map[string]activePing
+	pingHandler   func(ctx context.Context, payload []byte) error
+	pongHandler   func(payload []byte, rtt time.Duration)
+	lastRTT       xsync.Int64
+}
+
+type activePing struct {
+	pong chan<- struct{}
+	sent time.Time
 }
 
 type connConfig struct {
 	subprotocol    string
+	extensions     string
 	rwc            io.ReadWriteCloser
+	netConn        net.Conn
 	client         bool
 	copts          *compressionOptions
 	flateThreshold int
 
 	br *bufio.Reader
 	bw *bufio.Writer
+
+	closeHandshakeTimeout time.Duration
+	compressionFallback   bool
+	compressionDict       []byte
+	writeQueueSize        int
+	disableMasking        bool
+	maxFragments          int
+	maxWireFrameSize      int64
+	onWriteProgress       func(written int64)
+	onReadProgress        func(read int64)
+	onMessageWritten      func(typ MessageType, uncompressed, wire int)
+	onError               func(err error)
+	idleTimeout           time.Duration
+	maxPingsPerSecond     int
+	closePingFlood        bool
+	maxConnectionAge      time.Duration
+	maxConnectionAgeGrace time.Duration
 }
 
 func newConn(cfg connConfig) *Conn {
 	c := &Conn{
 		subprotocol:    cfg.subprotocol,
+		extensions:     cfg.extensions,
 		rwc:            cfg.rwc,
+		netConn:        cfg.netConn,
 		client:         cfg.client,
+		disableMasking: cfg.disableMasking,
 		copts:          cfg.copts,
 		flateThreshold: cfg.flateThreshold,
 
 		br: cfg.br,
 		bw: cfg.bw,
 
+		closeHandshakeTimeout: cfg.closeHandshakeTimeout,
+		compressionFallback:   cfg.compressionFallback,
+		compressionDict:       cfg.compressionDict,
+		maxFragments:          cfg.maxFragments,
+		maxWireFrameSize:      cfg.maxWireFrameSize,
+		onWriteProgress:       cfg.onWriteProgress,
+		onReadProgress:        cfg.onReadProgress,
+		onMessageWritten:      cfg.onMessageWritten,
+		onError:               cfg.onError,
+		idleTimeout:           cfg.idleTimeout,
+		closePingFlood:        cfg.closePingFlood,
+		maxConnectionAgeGrace: cfg.maxConnectionAgeGrace,
+
 		readTimeout:  make(chan context.Context),
 		writeTimeout: make(chan context.Context),
 
 		closed:      make(chan struct{}),
-		activePings: make(map[string]chan<- struct{}),
+		activePings: make(map[string]activePing),
+	}
+	c.ctx, c.cancelCtx = withCancelCause(context.Background())
+
+	if c.closeHandshakeTimeout == 0 {
+		c.closeHandshakeTimeout = defaultCloseHandshakeTimeout
+	}
+
+	if cfg.writeQueueSize > 0 {
+		c.writeQueue = make(chan queuedMsg, cfg.writeQueueSize)
 	}
 
 	c.readMu = newMu(c)
@@ -96,7 +196,7 @@ func newConn(cfg connConfig) *Conn {
 	c.msgReader = newMsgReader(c)
 
 	c.msgWriterState = newMsgWriterState(c)
-	if c.client {
+	if c.client && !c.disableMasking {
 		c.writeBuf = extractBufioWriterBuf(c.bw, c.rwc)
 	}
 
@@ -111,7 +211,22 @@ func newConn(cfg connConfig) *Conn {
 		c.close(errors.New("connection garbage collected"))
 	})
 
+	if cfg.maxPingsPerSecond > 0 {
+		c.pingLimiter = newPingLimiter(cfg.maxPingsPerSecond)
+	}
+
+	if cfg.maxConnectionAge > 0 {
+		c.ageTimer = time.AfterFunc(cfg.maxConnectionAge, c.maxConnectionAgeReached)
+	}
+
+	if c.idleTimeout > 0 {
+		c.idleTimer = time.AfterFunc(c.idleTimeout, c.idleTimedOut)
+	}
+
 	go c.timeoutLoop()
+	if c.writeQueue != nil {
+		go c.writeQueueLoop()
+	}
 
 	return c
 }
@@ -122,6 +237,28 @@ func (c *Conn) Subprotocol() string {
 	return c.subprotocol
 }
 
+// NegotiatedExtensions returns the Sec-WebSocket-Extensions header value of
+// the handshake response, i.e. the extensions in use such as permessage-deflate
+// along with their parameters. An empty string means no extensions.
+func (c *Conn) NegotiatedExtensions() string {
+	return c.extensions
+}
+
+// NetConn returns the underlying transport connection, e.g. to set socket
+// options such as TCP_NODELAY or to inspect the peer's TLS certificate.
+// It is not to be confused with the NetConn function which wraps a *Conn.
+//
+// Never read from, write to or set deadlines on the returned net.Conn.
+// Doing so will corrupt the WebSocket protocol. Use it only for inspection
+// and socket level tuning.
+//
+// For a server, it is the hijacked connection. For a client it is the
+// connection the handshake was performed on, or nil if it is not known
+// such as when a custom HTTPClient transport does not expose it.
+func (c *Conn) NetConn() net.Conn {
+	return c.netConn
+}
+
 func (c *Conn) close(err error) {
 	c.closeMu.Lock()
 	defer c.closeMu.Unlock()
@@ -131,12 +268,28 @@ func (c *Conn) close(err error) {
 	}
 	c.setCloseErrLocked(err)
 	close(c.closed)
+	c.cancelCtx(c.closeErr)
+	if c.onError != nil {
+		// The connection failed unless it was closed by either peer's close frame.
+		switch CloseStatus(c.closeErr) {
+		case -1, StatusAbnormalClosure:
+			go c.onError(c.closeErr)
+		}
+	}
 	runtime.SetFinalizer(c, nil)
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+	}
+	if c.ageTimer != nil {
+		c.ageTimer.Stop()
+	}
 
 	// Have to close after c.closed is closed to ensure any goroutine that wakes up
 	// from the connection being closed also sees that c.closed is closed and returns
 	// closeErr.
-	c.rwc.Close()
+	if !c.keepNetConn {
+		c.rwc.Close()
+	}
 
 	go func() {
 		c.msgWriterState.close()
@@ -145,6 +298,36 @@ func (c *Conn) close(err error) {
 	}()
 }
 
+func (c *Conn) maxConnectionAgeReached() {
+	ctx, cancel := context.WithTimeout(context.Background(), c.maxConnectionAgeGrace)
+	defer cancel()
+
+	// Wait for any message being written to complete and prevent new ones
+	// from starting in the meantime. The lock must be released before Close
+	// as writeQueueLoop needs it to write the queued messages Close flushes.
+	err := c.msgWriterState.mu.lock(ctx)
+	if err == nil {
+		c.msgWriterState.mu.unlock()
+	}
+	if c.isClosed() {
+		return
+	}
+
+	// Close is a no-op if the connection is already being closed.
+	c.Close(StatusGoingAway, "max connection age reached")
+}
+
+func (c *Conn) idleTimedOut() {
+	c.closeMu.Lock()
+	closing := c.wroteClose || c.isClosed()
+	c.closeMu.Unlock()
+	if closing {
+		return
+	}
+
+	c.writeError(StatusPolicyViolation, fmt.Errorf("no frames received for %v", c.idleTimeout))
+}
+
 func (c *Conn) timeoutLoop() {
 	readCtx := context.Background()
 	writeCtx := context.Background()
@@ -167,6 +350,22 @@ func (c *Conn) timeoutLoop() {
 	}
 }
 
+// defaultCloseHandshakeTimeout is used when the CloseHandshakeTimeout option is unset.
+const defaultCloseHandshakeTimeout = time.Second * 5
+
+// withCloseHandshakeTimeout bounds ctx by the close handshake timeout
+// unless it has been disabled.
+func (c *Conn) withCloseHandshakeTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.closeHandshakeTimeout < 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, c.closeHandshakeTimeout)
+}
+
+func (c *Conn) deflateFrame() bool {
+	return c.copts != nil && c.copts.deflateFrame
+}
+
 func (c *Conn) flate() bool {
 	return c.copts != nil
 }
@@ -192,7 +391,10 @@ func (c *Conn) ping(ctx context.Context, p string) error {
 	pong := make(chan struct{})
 
 	c.activePingsMu.Lock()
-	c.activePings[p] = pong
+	c.activePings[p] = activePing{
+		pong: pong,
+		sent: time.Now(),
+	}
 	c.activePingsMu.Unlock()
 
 	defer func() {
@@ -218,6 +420,64 @@ func (c *Conn) ping(ctx context.Context, p string) error {
 	}
 }
 
+// SetPingHandler sets a function to be called whenever a ping is received,
+// before the automatic pong reply is written.
+//
+// If the handler returns ErrSkipPong, no pong is written. Any other
+// non nil error closes the connection with StatusPolicyViolation.
+// The passed context is bounded by the CloseHandshakeTimeout option
+// as is the write of the pong. The payload is only valid for the duration
+// of the call.
+//
+// The handler is called on the goroutine reading from the connection.
+//
+// Pass nil to restore the default behaviour of always replying with a pong.
+func (c *Conn) SetPingHandler(fn func(ctx context.Context, payload []byte) error) {
+	c.activePingsMu.Lock()
+	c.pingHandler = fn
+	c.activePingsMu.Unlock()
+}
+
+// ConnStats holds statistics about a connection.
+type ConnStats struct {
+	// CompressionFallbacks is the number of messages sent uncompressed
+	// as compressing them would not have made them smaller.
+	// See the CompressionFallback option.
+	CompressionFallbacks int64
+}
+
+// Stats returns statistics about the connection.
+func (c *Conn) Stats() ConnStats {
+	return ConnStats{
+		CompressionFallbacks: c.compressionFallbacks.Load(),
+	}
+}
+
+// LastRTT returns the round trip time of the most recent ping sent
+// with Ping that was answered by the peer.
+//
+// It returns zero until the first pong is received.
+func (c *Conn) LastRTT() time.Duration {
+	return time.Duration(c.lastRTT.Load())
+}
+
+// SetPongHandler sets a function to be called whenever a pong is received.
+//
+// rtt is the time elapsed since the matching ping was sent by Ping.
+// It is zero for unsolicited pongs. The payload is only valid for the
+// duration of the call.
+//
+// The handler is purely observational, Ping still waits for its pong as usual.
+// It is called on the goroutine reading from the connection so it must not
+// block for long, otherwise reads and control frame handling will stall.
+//
+// Pass nil to remove the handler.
+func (c *Conn) SetPongHandler(fn func(payload []byte, rtt time.Duration)) {
+	c.activePingsMu.Lock()
+	c.pongHandler = fn
+	c.activePingsMu.Unlock()
+}
+
 type mu struct {
 	c  *Conn
 	ch chan struct{}
@@ -239,9 +499,7 @@ func (m *mu) lock(ctx context.Context) error {
 	case <-m.c.closed:
 		return m.c.closeErr
 	case <-ctx.Done():
-		err := fmt.Errorf("failed to acquire lock: %w", ctx.Err())
-		m.c.close(err)
-		return err
+		return fmt.Errorf("failed to acquire lock: %w", ctx.Err())
 	case m.ch <- struct{}{}:
 		// To make sure the connection is certainly alive.
 		// As it's possible the send on m.ch was selected
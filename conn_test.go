@@ -5,20 +5,27 @@ package websocket_test
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang/protobuf/ptypes"
 	"github.com/golang/protobuf/ptypes/duration"
+	structpb "github.com/golang/protobuf/ptypes/struct"
 
 	"nhooyr.io/websocket"
 	"nhooyr.io/websocket/internal/errd"
@@ -66,153 +73,1717 @@ func TestConn(t *testing.T) {
 		}
 	})
 
+	t.Run("bufferSizes", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			ReadBufferSize:  16,
+			WriteBufferSize: 33,
+		}, &websocket.AcceptOptions{
+			ReadBufferSize:  16,
+			WriteBufferSize: 33,
+		})
+		defer tt.cleanup()
+
+		tt.goEchoLoop(c2)
+
+		c1.SetReadLimit(131072)
+
+		for i := 0; i < 5; i++ {
+			err := wstest.Echo(tt.ctx, c1, 131072)
+			assert.Success(t, err)
+		}
+
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("tinyWriteBuffer", func(t *testing.T) {
+		// Smaller than the largest frame header so headers span flushes
+		// and every write of the masked payload is split up.
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			WriteBufferSize: 4,
+		}, &websocket.AcceptOptions{
+			WriteBufferSize: 4,
+		})
+		defer tt.cleanup()
+
+		tt.goEchoLoop(c2)
+
+		c1.SetReadLimit(1 << 20)
+
+		// 125, 65535 and 65536 bytes are the boundaries of the 7, 16 and
+		// 64 bit payload lengths.
+		for _, n := range []int{0, 1, 3, 125, 126, 4097, 65535, 65536, 70000} {
+			msg := xrand.Bytes(n)
+			werr := xsync.Go(func() error {
+				return c1.Write(tt.ctx, websocket.MessageBinary, msg)
+			})
+
+			_, b, err := c1.Read(tt.ctx)
+			assert.Success(t, err)
+			if !bytes.Equal(msg, b) {
+				t.Fatalf("corrupted echo of %v bytes", n)
+			}
+			assert.Success(t, <-werr)
+		}
+
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("maxFragments", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			MaxFragments: 3,
+		}, &websocket.AcceptOptions{
+			MaxFragments: 3,
+		})
+		defer tt.cleanup()
+
+		c1.CloseRead(tt.ctx)
+
+		werr := xsync.Go(func() error {
+			w, err := c1.Writer(tt.ctx, websocket.MessageBinary)
+			if err != nil {
+				return err
+			}
+			for i := 0; i < 5; i++ {
+				_, err = w.Write([]byte{byte(i)})
+				if err != nil {
+					return err
+				}
+			}
+			return w.Close()
+		})
+
+		_, _, err := c2.Read(tt.ctx)
+		assert.Contains(t, err, "received message with more than 3 fragments")
+
+		// The writer may or may not see the close depending on
+		// how much was written before the peer closed.
+		<-werr
+	})
+
+	t.Run("maxWireFrameSize", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode:  websocket.CompressionNoContextTakeover,
+			MaxWireFrameSize: 1024,
+		}, &websocket.AcceptOptions{
+			CompressionMode:  websocket.CompressionNoContextTakeover,
+			MaxWireFrameSize: 1024,
+		})
+		defer tt.cleanup()
+
+		c1.CloseRead(tt.ctx)
+		c2.SetReadLimit(-1)
+
+		// Compresses to well within the wire limit.
+		werr := xsync.Go(func() error {
+			return c1.Write(tt.ctx, websocket.MessageBinary, make([]byte, 65536))
+		})
+		_, p, err := c2.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "msg length", 65536, len(p))
+		assert.Success(t, <-werr)
+
+		werr = xsync.Go(func() error {
+			return c1.Write(tt.ctx, websocket.MessageBinary, xrand.Bytes(4096))
+		})
+		_, _, err = c2.Read(tt.ctx)
+		assert.Contains(t, err, "exceeding max wire frame size of 1024 bytes")
+
+		// The writer may or may not see the close depending on
+		// how much was written before the peer closed.
+		<-werr
+	})
+
+	t.Run("progress", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		var written, read []int64
+		c1, c2 := wstest.Pipe(&websocket.DialOptions{
+			OnWriteProgress: func(n int64) {
+				written = append(written, n)
+			},
+		}, &websocket.AcceptOptions{
+			OnReadProgress: func(n int64) {
+				read = append(read, n)
+			},
+		})
+		defer c2.Close(websocket.StatusInternalError, "")
+		defer c1.Close(websocket.StatusInternalError, "")
+
+		werr := xsync.Go(func() error {
+			w, err := c1.Writer(ctx, websocket.MessageBinary)
+			if err != nil {
+				return err
+			}
+			for i := 0; i < 3; i++ {
+				_, err = w.Write(xrand.Bytes(1000))
+				if err != nil {
+					return err
+				}
+			}
+			err = w.Close()
+			if err != nil {
+				return err
+			}
+			return c1.Write(ctx, websocket.MessageBinary, xrand.Bytes(500))
+		})
+
+		_, r, err := c2.Reader(ctx)
+		assert.Success(t, err)
+		n, err := io.CopyBuffer(ioutil.Discard, r, make([]byte, 1000))
+		assert.Success(t, err)
+		assert.Equal(t, "read", int64(3000), n)
+		assert.Equal(t, "read progress", int64(3000), read[len(read)-1])
+
+		read = nil
+		_, _, err = c2.Read(ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "read progress", int64(500), read[len(read)-1])
+
+		assert.Success(t, <-werr)
+		assert.Equal(t, "write progress", []int64{1000, 2000, 3000, 500}, written)
+
+		c1.CloseRead(ctx)
+		c2.CloseRead(ctx)
+	})
+
+	t.Run("onMessageWritten", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		type msg struct {
+			typ          websocket.MessageType
+			uncompressed int
+			wire         int
+		}
+		var msgs []msg
+		c1, c2 := wstest.Pipe(&websocket.DialOptions{
+			CompressionMode: websocket.CompressionContextTakeover,
+			OnMessageWritten: func(typ websocket.MessageType, uncompressed, wire int) {
+				msgs = append(msgs, msg{typ, uncompressed, wire})
+			},
+		}, &websocket.AcceptOptions{
+			CompressionMode: websocket.CompressionContextTakeover,
+		})
+		defer c2.Close(websocket.StatusInternalError, "")
+		defer c1.Close(websocket.StatusInternalError, "")
+
+		rerr := xsync.Go(func() error {
+			for i := 0; i < 3; i++ {
+				_, _, err := c2.Read(ctx)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		// Below the threshold so it is not compressed.
+		err := c1.Write(ctx, websocket.MessageText, []byte("hi"))
+		assert.Success(t, err)
+
+		text := []byte(strings.Repeat("hello world ", 100))
+		err = c1.Write(ctx, websocket.MessageText, text)
+		assert.Success(t, err)
+
+		w, err := c1.Writer(ctx, websocket.MessageBinary)
+		assert.Success(t, err)
+		for i := 0; i < 3; i++ {
+			_, err = w.Write(text)
+			assert.Success(t, err)
+		}
+		err = w.Close()
+		assert.Success(t, err)
+		assert.Success(t, <-rerr)
+
+		assert.Equal(t, "messages", 3, len(msgs))
+		assert.Equal(t, "uncompressed", msg{websocket.MessageText, 2, 2}, msgs[0])
+		for i, exp := range []msg{{websocket.MessageText, len(text), 0}, {websocket.MessageBinary, len(text) * 3, 0}} {
+			m := msgs[i+1]
+			assert.Equal(t, "type", exp.typ, m.typ)
+			assert.Equal(t, "uncompressed", exp.uncompressed, m.uncompressed)
+			if m.wire <= 0 || m.wire >= m.uncompressed/2 {
+				t.Fatalf("expected message to be compressed on the wire: %+v", m)
+			}
+		}
+
+		c1.CloseRead(ctx)
+		c2.CloseRead(ctx)
+	})
+
+	t.Run("onError", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		errs := make(chan error, 2)
+		c1, c2 := wstest.Pipe(&websocket.DialOptions{
+			OnError: func(err error) {
+				errs <- err
+			},
+		}, nil)
+		defer c2.Close(websocket.StatusInternalError, "")
+		defer c1.Close(websocket.StatusInternalError, "")
+
+		// c2 never reads so the ping fails.
+		pingCtx, cancel := context.WithTimeout(ctx, time.Millisecond*50)
+		defer cancel()
+		err := c1.Ping(pingCtx)
+		assert.Error(t, err)
+
+		select {
+		case err := <-errs:
+			assert.Contains(t, err, "context deadline exceeded")
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		}
+
+		// Only called once.
+		c1.Close(websocket.StatusNormalClosure, "")
+		select {
+		case err := <-errs:
+			t.Fatalf("unexpected second call: %v", err)
+		case <-time.After(time.Millisecond * 50):
+		}
+
+		// Not called on a close handshake.
+		c1, c2 = wstest.Pipe(&websocket.DialOptions{
+			OnError: func(err error) {
+				errs <- err
+			},
+		}, nil)
+		c2.CloseRead(ctx)
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+		select {
+		case err := <-errs:
+			t.Fatalf("unexpected call: %v", err)
+		case <-time.After(time.Millisecond * 50):
+		}
+	})
+
+	t.Run("idleTimeout", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		c1, c2 := wstest.Pipe(nil, &websocket.AcceptOptions{
+			IdleTimeout: time.Millisecond * 100,
+		})
+		defer c2.Close(websocket.StatusInternalError, "")
+		defer c1.Close(websocket.StatusInternalError, "")
+
+		c2.CloseRead(ctx)
+
+		// Pings reset the idle timer.
+		start := time.Now()
+		perr := xsync.Go(func() error {
+			for i := 0; i < 4; i++ {
+				time.Sleep(time.Millisecond * 50)
+				err := c1.Ping(ctx)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		_, _, err := c1.Read(ctx)
+		assert.Equal(t, "close status", websocket.StatusPolicyViolation, websocket.CloseStatus(err))
+		assert.Contains(t, err, "no frames received for 100ms")
+		if time.Since(start) < time.Millisecond*200 {
+			t.Fatalf("closed before pings stopped: %v", time.Since(start))
+		}
+		assert.Success(t, <-perr)
+	})
+
+	t.Run("idleTimeout/notReading", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		c1, c2 := wstest.Pipe(nil, &websocket.AcceptOptions{
+			IdleTimeout: time.Millisecond * 100,
+		})
+		defer c2.Close(websocket.StatusInternalError, "")
+		defer c1.Close(websocket.StatusInternalError, "")
+
+		// The client is busy reading but the server only writes so it never
+		// reads a frame and the connection is closed regardless.
+		werr := xsync.Go(func() error {
+			for {
+				err := c2.Write(ctx, websocket.MessageText, []byte("hi"))
+				if err != nil {
+					return err
+				}
+				time.Sleep(time.Millisecond * 10)
+			}
+		})
+		start := time.Now()
+		var err error
+		for err == nil {
+			_, _, err = c1.Read(ctx)
+		}
+		assert.Equal(t, "close status", websocket.StatusPolicyViolation, websocket.CloseStatus(err))
+		if d := time.Since(start); d > time.Second {
+			t.Fatalf("took %v to close", d)
+		}
+		<-werr
+	})
+
+	t.Run("maxPingsPerSecond", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		c1, c2 := wstest.Pipe(nil, &websocket.AcceptOptions{
+			MaxPingsPerSecond: 2,
+		})
+		defer c2.Close(websocket.StatusInternalError, "")
+		defer c1.Close(websocket.StatusInternalError, "")
+
+		c1.CloseRead(ctx)
+		c2.CloseRead(ctx)
+
+		for i := 0; i < 2; i++ {
+			err := c1.Ping(ctx)
+			assert.Success(t, err)
+		}
+
+		// The bucket refills at the sustained rate.
+		time.Sleep(time.Millisecond * 500)
+		err := c1.Ping(ctx)
+		assert.Success(t, err)
+
+		// The bucket is empty so the next ping is dropped.
+		pingCtx, cancel := context.WithTimeout(ctx, time.Millisecond*100)
+		defer cancel()
+		err = c1.Ping(pingCtx)
+		assert.Contains(t, err, "failed to wait for pong: context deadline exceeded")
+	})
+
+	t.Run("closePingFlood", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		c1, c2 := wstest.Pipe(nil, &websocket.AcceptOptions{
+			MaxPingsPerSecond: 1,
+			ClosePingFlood:    true,
+		})
+		defer c2.Close(websocket.StatusInternalError, "")
+		defer c1.Close(websocket.StatusInternalError, "")
+
+		c2.CloseRead(ctx)
+
+		perr := xsync.Go(func() error {
+			for i := 0; i < 2; i++ {
+				err := c1.Ping(ctx)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		_, _, err := c1.Read(ctx)
+		assert.Equal(t, "close status", websocket.StatusPolicyViolation, websocket.CloseStatus(err))
+		assert.Contains(t, err, "exceeded maximum pings per second")
+		assert.Error(t, <-perr)
+	})
+
+	t.Run("maxConnectionAge/writeQueue", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		c1, c2 := wstest.Pipe(nil, &websocket.AcceptOptions{
+			MaxConnectionAge:      time.Millisecond * 100,
+			MaxConnectionAgeGrace: time.Second * 5,
+			WriteQueueSize:        16,
+			CloseHandshakeTimeout: time.Second * 5,
+		})
+		defer c2.Close(websocket.StatusInternalError, "")
+		defer c1.Close(websocket.StatusInternalError, "")
+
+		c2.CloseRead(ctx)
+
+		for i := 0; i < 10; i++ {
+			err := c2.Write(ctx, websocket.MessageText, []byte(strconv.Itoa(i)))
+			assert.Success(t, err)
+		}
+
+		// The queued messages are only read once the age is reached so the
+		// close must flush them rather than wait out CloseHandshakeTimeout.
+		time.Sleep(time.Millisecond * 200)
+		start := time.Now()
+		for i := 0; i < 10; i++ {
+			_, b, err := c1.Read(ctx)
+			assert.Success(t, err)
+			assert.Equal(t, "read msg", strconv.Itoa(i), string(b))
+		}
+		_, _, err := c1.Read(ctx)
+		assert.Equal(t, "close status", websocket.StatusGoingAway, websocket.CloseStatus(err))
+		if dur := time.Since(start); dur > time.Second {
+			t.Fatalf("close took too long: %v", dur)
+		}
+	})
+
+	t.Run("maxConnectionAge", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		c1, c2 := wstest.Pipe(nil, &websocket.AcceptOptions{
+			MaxConnectionAge:      time.Millisecond * 100,
+			MaxConnectionAgeGrace: time.Second * 5,
+		})
+		defer c2.Close(websocket.StatusInternalError, "")
+		defer c1.Close(websocket.StatusInternalError, "")
+
+		c2.CloseRead(ctx)
+
+		// A message in progress when the age is reached is allowed to complete.
+		w, err := c2.Writer(ctx, websocket.MessageText)
+		assert.Success(t, err)
+		werr := xsync.Go(func() error {
+			_, err := w.Write([]byte("hello"))
+			if err != nil {
+				return err
+			}
+			time.Sleep(time.Millisecond * 200)
+			_, err = w.Write([]byte(" world"))
+			if err != nil {
+				return err
+			}
+			return w.Close()
+		})
+
+		_, b, err := c1.Read(ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "read msg", "hello world", string(b))
+		assert.Success(t, <-werr)
+
+		_, _, err = c1.Read(ctx)
+		assert.Equal(t, "close status", websocket.StatusGoingAway, websocket.CloseStatus(err))
+		assert.Contains(t, err, "max connection age reached")
+	})
+
+	t.Run("resetCompressionDict", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode: websocket.CompressionContextTakeover,
+		}, &websocket.AcceptOptions{
+			CompressionMode: websocket.CompressionContextTakeover,
+		})
+		defer tt.cleanup()
+
+		tt.goEchoLoop(c2)
+
+		bytesWritten := c1.RecordBytesWritten()
+
+		msg := []byte(xrand.String(1024))
+		echo := func() int {
+			prev := *bytesWritten
+			err := c1.Write(tt.ctx, websocket.MessageText, msg)
+			assert.Success(t, err)
+			_, b, err := c1.Read(tt.ctx)
+			assert.Success(t, err)
+			assert.Equal(t, "read msg", msg, b)
+			return *bytesWritten - prev
+		}
+
+		first := echo()
+		takeover := echo()
+		if takeover >= first/2 {
+			t.Fatalf("expected context takeover to shrink repeated message: %v vs %v", takeover, first)
+		}
+
+		c1.ResetCompressionDict()
+		reset := echo()
+		assert.Equal(t, "bytes written after reset", first, reset)
+
+		// Context takeover resumes after the reset message.
+		assert.Equal(t, "bytes written after resume", takeover, echo())
+
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("negotiatedExtensions", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode: websocket.CompressionNoContextTakeover,
+		}, &websocket.AcceptOptions{
+			CompressionMode: websocket.CompressionNoContextTakeover,
+		})
+		defer tt.cleanup()
+
+		c1.CloseRead(tt.ctx)
+		c2.CloseRead(tt.ctx)
+
+		assert.Contains(t, c1.NegotiatedExtensions(), "permessage-deflate")
+		assert.Equal(t, "extensions", c1.NegotiatedExtensions(), c2.NegotiatedExtensions())
+
+		c3, c4 := wstest.Pipe(&websocket.DialOptions{
+			CompressionMode: websocket.CompressionDisabled,
+		}, nil)
+		defer c3.Close(websocket.StatusInternalError, "")
+		defer c4.Close(websocket.StatusInternalError, "")
+		c3.CloseRead(tt.ctx)
+		c4.CloseRead(tt.ctx)
+
+		assert.Equal(t, "extensions", "", c3.NegotiatedExtensions())
+		assert.Equal(t, "extensions", "", c4.NegotiatedExtensions())
+	})
+
+	t.Run("compressionFallback", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode:     websocket.CompressionContextTakeover,
+			CompressionFallback: true,
+		}, &websocket.AcceptOptions{
+			CompressionMode:     websocket.CompressionContextTakeover,
+			CompressionFallback: true,
+		})
+		defer tt.cleanup()
+
+		tt.goEchoLoop(c2)
+
+		bytesWritten := c1.RecordBytesWritten()
+
+		echo := func(msg []byte) int {
+			prev := *bytesWritten
+			err := c1.Write(tt.ctx, websocket.MessageBinary, msg)
+			assert.Success(t, err)
+			_, b, err := c1.Read(tt.ctx)
+			assert.Success(t, err)
+			assert.Equal(t, "read msg", msg, b)
+			return *bytesWritten - prev
+		}
+
+		text := []byte(strings.Repeat("hello world ", 100))
+		if n := echo(text); n >= len(text)/2 {
+			t.Fatalf("expected compressible message to be compressed: %v", n)
+		}
+		assert.Equal(t, "fallbacks", int64(0), c1.Stats().CompressionFallbacks)
+
+		// Random bytes only grow when compressed.
+		random := xrand.Bytes(1024)
+		if n := echo(random); n > len(random)+8 {
+			t.Fatalf("expected incompressible message to be sent uncompressed: %v", n)
+		}
+		assert.Equal(t, "fallbacks", int64(1), c1.Stats().CompressionFallbacks)
+
+		// The dictionary stays in sync with the peer after the fallback.
+		echo(text)
+		echo(text)
+
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("compressionDictionary", func(t *testing.T) {
+		dict := xrand.Bytes(2048)
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode:       websocket.CompressionNoContextTakeover,
+			CompressionDictionary: dict,
+		}, &websocket.AcceptOptions{
+			CompressionMode:       websocket.CompressionNoContextTakeover,
+			CompressionDictionary: dict,
+		})
+		defer tt.cleanup()
+
+		tt.goEchoLoop(c2)
+
+		bytesWritten := c1.RecordBytesWritten()
+
+		// Every message starts from the dictionary without context takeover.
+		for i := 0; i < 3; i++ {
+			msg := append(append([]byte(nil), dict...), fmt.Sprintf(`{"id": %d}`, i)...)
+
+			prev := *bytesWritten
+			err := c1.Write(tt.ctx, websocket.MessageBinary, msg)
+			assert.Success(t, err)
+			if n := *bytesWritten - prev; n > 128 {
+				t.Fatalf("expected message to be compressed against the dictionary: %v", n)
+			}
+
+			_, b, err := c1.Read(tt.ctx)
+			assert.Success(t, err)
+			assert.Equal(t, "read msg", msg, b)
+		}
+
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("resetCompressionDictionary", func(t *testing.T) {
+		dict := xrand.Bytes(2048)
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			CompressionMode:       websocket.CompressionContextTakeover,
+			CompressionDictionary: dict,
+		}, &websocket.AcceptOptions{
+			CompressionMode:       websocket.CompressionContextTakeover,
+			CompressionDictionary: dict,
+		})
+		defer tt.cleanup()
+
+		tt.goEchoLoop(c2)
+
+		echo := func(msg []byte) {
+			err := c1.Write(tt.ctx, websocket.MessageBinary, msg)
+			assert.Success(t, err)
+			_, b, err := c1.Read(tt.ctx)
+			assert.Success(t, err)
+			assert.Equal(t, "read msg", msg, b)
+		}
+
+		// Messages reference both the dictionary and previous messages
+		// so the windows on both ends must stay in sync across the reset.
+		msg := append(append([]byte(nil), dict[:1024]...), xrand.Bytes(1024)...)
+		echo(msg)
+		echo(msg)
+
+		c1.ResetCompressionDict()
+		echo(msg)
+		echo(append(append([]byte(nil), dict...), msg...))
+		echo(msg)
+
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
 	t.Run("badClose", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c2.CloseRead(tt.ctx)
+
+		err := c1.Close(-1, "")
+		assert.Contains(t, err, "failed to marshal close frame: status code StatusCode(-1) cannot be set")
+
+		// Nothing was written so the connection can still be closed.
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("closeHandshakeTimeout", func(t *testing.T) {
+		tt, c1, _ := newConnTest(t, &websocket.DialOptions{
+			CloseHandshakeTimeout: time.Millisecond * 100,
+		}, &websocket.AcceptOptions{
+			CloseHandshakeTimeout: time.Millisecond * 100,
+		})
+		defer tt.cleanup()
+
+		// The peer never reads so neither the close frame write
+		// nor the wait for the peer's close frame can complete.
+		start := time.Now()
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Error(t, err)
+		if dur := time.Since(start); dur > time.Second {
+			t.Fatalf("close handshake took %v despite 100ms timeout", dur)
+		}
+	})
+
+	t.Run("ping", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c1.CloseRead(tt.ctx)
+		c2.CloseRead(tt.ctx)
+
+		for i := 0; i < 10; i++ {
+			err := c1.Ping(tt.ctx)
+			assert.Success(t, err)
+		}
+
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("closeRead", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		ctx := c2.CloseRead(tt.ctx)
+
+		_, _, err := c2.Read(tt.ctx)
+		assert.Contains(t, err, "read closed")
+
+		err = c1.Write(tt.ctx, websocket.MessageText, []byte("hello"))
+		assert.Success(t, err)
+
+		_, _, err = c1.Read(tt.ctx)
+		assert.Equal(t, "close status", websocket.StatusPolicyViolation, websocket.CloseStatus(err))
+
+		select {
+		case <-ctx.Done():
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+	})
+
+	t.Run("pingHandler", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		var pings int
+		c2.SetPingHandler(func(ctx context.Context, payload []byte) error {
+			pings++
+			if pings > 1 {
+				return websocket.ErrSkipPong
+			}
+			return nil
+		})
+
+		c1.CloseRead(tt.ctx)
+		c2.CloseRead(tt.ctx)
+
+		err := c1.Ping(tt.ctx)
+		assert.Success(t, err)
+
+		ctx, cancel := context.WithTimeout(tt.ctx, time.Millisecond*100)
+		defer cancel()
+
+		err = c1.Ping(ctx)
+		assert.Contains(t, err, "failed to wait for pong")
+	})
+
+	t.Run("pongHandler", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		rtts := make(chan time.Duration, 1)
+		c1.SetPongHandler(func(payload []byte, rtt time.Duration) {
+			assert.Equal(t, "payload", "1", string(payload))
+			rtts <- rtt
+		})
+
+		c1.CloseRead(tt.ctx)
+		c2.CloseRead(tt.ctx)
+
+		assert.Equal(t, "last rtt", time.Duration(0), c1.LastRTT())
+
+		err := c1.Ping(tt.ctx)
+		assert.Success(t, err)
+
+		select {
+		case rtt := <-rtts:
+			if rtt <= 0 {
+				t.Fatalf("expected positive rtt: %v", rtt)
+			}
+			assert.Equal(t, "last rtt", rtt, c1.LastRTT())
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("badPing", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c2.CloseRead(tt.ctx)
+
+		ctx, cancel := context.WithTimeout(tt.ctx, time.Millisecond*100)
+		defer cancel()
+
+		err := c1.Ping(ctx)
+		assert.Contains(t, err, "failed to wait for pong")
+	})
+
+	t.Run("concurrentWrite", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		tt.goDiscardLoop(c2)
+
+		msg := xrand.Bytes(xrand.Int(9999))
+		const count = 100
+		errs := make(chan error, count)
+
+		for i := 0; i < count; i++ {
+			go func() {
+				select {
+				case errs <- c1.Write(tt.ctx, websocket.MessageBinary, msg):
+				case <-tt.ctx.Done():
+					return
+				}
+			}()
+		}
+
+		for i := 0; i < count; i++ {
+			select {
+			case err := <-errs:
+				assert.Success(t, err)
+			case <-tt.ctx.Done():
+				t.Fatal(tt.ctx.Err())
+			}
+		}
+
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("concurrentWriteError", func(t *testing.T) {
+		tt, c1, _ := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		_, err := c1.Writer(tt.ctx, websocket.MessageText)
+		assert.Success(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		defer cancel()
+
+		err = c1.Write(ctx, websocket.MessageText, []byte("x"))
+		assert.Equal(t, "write error", context.DeadlineExceeded, err)
+	})
+
+	t.Run("writeTimeoutRecover", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		tt.goEchoLoop(c2)
+
+		w, err := c1.Writer(tt.ctx, websocket.MessageText)
+		assert.Success(t, err)
+
+		ctx, cancel := context.WithTimeout(tt.ctx, time.Millisecond*100)
+		defer cancel()
+
+		// The frame never started so the connection remains usable.
+		err = c1.Write(ctx, websocket.MessageText, []byte("x"))
+		assert.Equal(t, "write error", context.DeadlineExceeded, err)
+
+		_, err = w.Write([]byte("hello"))
+		assert.Success(t, err)
+		err = w.Close()
+		assert.Success(t, err)
+
+		_, b, err := c1.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "read msg", "hello", string(b))
+
+		err = c1.Write(tt.ctx, websocket.MessageText, []byte("world"))
+		assert.Success(t, err)
+
+		_, b, err = c1.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "read msg", "world", string(b))
+
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("writeCancel", func(t *testing.T) {
+		t.Run("beforeHeader", func(t *testing.T) {
+			tt, c1, c2 := newConnTest(t, nil, nil)
+			defer tt.cleanup()
+
+			tt.goEchoLoop(c2)
+
+			ctx, cancel := context.WithCancel(tt.ctx)
+			cancel()
+
+			err := c1.Write(ctx, websocket.MessageText, []byte("x"))
+			assert.Equal(t, "write error", context.Canceled, err)
+
+			// Nothing was written so the connection remains usable.
+			err = wstest.Echo(tt.ctx, c1, 1024)
+			assert.Success(t, err)
+
+			err = c1.Close(websocket.StatusNormalClosure, "")
+			assert.Success(t, err)
+		})
+
+		t.Run("midPayload", func(t *testing.T) {
+			tt, c1, _ := newConnTest(t, nil, nil)
+			defer tt.cleanup()
+
+			ctx, cancel := context.WithCancel(tt.ctx)
+			time.AfterFunc(time.Millisecond*50, cancel)
+
+			// The peer never reads so the write blocks mid payload.
+			err := c1.Write(ctx, websocket.MessageBinary, xrand.Bytes(1<<20))
+			assert.Equal(t, "write error", context.Canceled, err)
+
+			// The partial frame cannot be recovered from.
+			err = c1.Write(tt.ctx, websocket.MessageText, []byte("x"))
+			assert.Error(t, err)
+		})
+
+		t.Run("afterFin", func(t *testing.T) {
+			tt, c1, c2 := newConnTest(t, nil, nil)
+			defer tt.cleanup()
+
+			tt.goEchoLoop(c2)
+
+			ctx, cancel := context.WithCancel(tt.ctx)
+			err := c1.Write(ctx, websocket.MessageText, []byte("hello"))
+			assert.Success(t, err)
+			cancel()
+
+			_, b, err := c1.Read(tt.ctx)
+			assert.Success(t, err)
+			assert.Equal(t, "read msg", "hello", string(b))
+
+			err = c1.Write(tt.ctx, websocket.MessageText, []byte("world"))
+			assert.Success(t, err)
+
+			_, b, err = c1.Read(tt.ctx)
+			assert.Success(t, err)
+			assert.Equal(t, "read msg", "world", string(b))
+
+			err = c1.Close(websocket.StatusNormalClosure, "")
+			assert.Success(t, err)
+		})
+	})
+
+	t.Run("readInto", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		tt.goEchoLoop(c2)
+
+		msg := xrand.Bytes(10)
+		err := c1.Write(tt.ctx, websocket.MessageBinary, msg)
+		assert.Success(t, err)
+
+		buf := make([]byte, 4)
+		typ, n, err := c1.ReadInto(tt.ctx, buf)
+		var btse websocket.BufferTooSmallError
+		if !errors.As(err, &btse) {
+			t.Fatalf("expected BufferTooSmallError: %v", err)
+		}
+		assert.Equal(t, "message size", int64(len(msg)), btse.Size)
+		assert.Equal(t, "n", len(buf), n)
+		assert.Equal(t, "read msg", msg[:n], buf)
+		assert.Equal(t, "message type", websocket.MessageBinary, typ)
+
+		err = c1.Write(tt.ctx, websocket.MessageBinary, msg)
+		assert.Success(t, err)
+
+		buf = make([]byte, btse.Size*2)
+		_, n, err = c1.ReadInto(tt.ctx, buf)
+		assert.Success(t, err)
+		assert.Equal(t, "read msg", msg, buf[:n])
+
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("disableMasking", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		c1, c2 := wstest.Pipe(&websocket.DialOptions{
+			DisableMasking: true,
+		}, nil)
+		defer c2.Close(websocket.StatusInternalError, "")
+		defer c1.Close(websocket.StatusInternalError, "")
+
+		werr := xsync.Go(func() error {
+			return c1.Write(ctx, websocket.MessageText, []byte("hello"))
+		})
+		rerr := xsync.Go(func() error {
+			_, _, err := c1.Read(ctx)
+			return err
+		})
+
+		_, _, err := c2.Read(ctx)
+		assert.Contains(t, err, "received unmasked frame from client")
+
+		err = <-rerr
+		assert.Equal(t, "close status", websocket.StatusProtocolError, websocket.CloseStatus(err))
+		assert.Success(t, <-werr)
+	})
+
+	t.Run("writeQueue", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			WriteQueueSize: 2,
+		}, &websocket.AcceptOptions{
+			WriteQueueSize: 2,
+		})
+		defer tt.cleanup()
+
+		// c2 is not reading so the queue will fill up.
+		var n int
+		for ; ; n++ {
+			if n > 10 {
+				t.Fatal("expected write queue to be full")
+			}
+			err := c1.Write(tt.ctx, websocket.MessageText, []byte(strconv.Itoa(n)))
+			if errors.Is(err, websocket.ErrWriteQueueFull) {
+				break
+			}
+			assert.Success(t, err)
+		}
+
+		for i := 0; i < n; i++ {
+			_, b, err := c2.Read(tt.ctx)
+			assert.Success(t, err)
+			assert.Equal(t, "read msg", strconv.Itoa(i), string(b))
+		}
+
+		c2.CloseRead(tt.ctx)
+		err := c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("writeQueue/close", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			WriteQueueSize: 4,
+		}, &websocket.AcceptOptions{
+			WriteQueueSize: 4,
+		})
+		defer tt.cleanup()
+
+		for i := 0; i < 3; i++ {
+			err := c1.Write(tt.ctx, websocket.MessageText, []byte(strconv.Itoa(i)))
+			assert.Success(t, err)
+		}
+		c1.CloseRead(tt.ctx)
+		errc := xsync.Go(func() error {
+			return c1.Close(websocket.StatusNormalClosure, "")
+		})
+
+		// The queued messages are written before the close frame.
+		for i := 0; i < 3; i++ {
+			_, b, err := c2.Read(tt.ctx)
+			assert.Success(t, err)
+			assert.Equal(t, "read msg", strconv.Itoa(i), string(b))
+		}
+		_, _, err := c2.Read(tt.ctx)
+		assert.Equal(t, "close status", websocket.StatusNormalClosure, websocket.CloseStatus(err))
+		assert.Success(t, <-errc)
+	})
+
+	t.Run("writeQueue/closeNoTimeout", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, &websocket.DialOptions{
+			WriteQueueSize:        64,
+			CloseHandshakeTimeout: -1,
+		}, &websocket.AcceptOptions{
+			WriteQueueSize:        64,
+			CloseHandshakeTimeout: -1,
+		})
+		defer tt.cleanup()
+
+		for i := 0; i < 50; i++ {
+			err := c1.Write(tt.ctx, websocket.MessageText, []byte(strconv.Itoa(i)))
+			assert.Success(t, err)
+		}
+		c1.CloseRead(tt.ctx)
+		errc := xsync.Go(func() error {
+			return c1.Close(websocket.StatusNormalClosure, "")
+		})
+
+		// Without a close handshake timeout, Close waits for every queued message.
+		for i := 0; i < 50; i++ {
+			_, b, err := c2.Read(tt.ctx)
+			assert.Success(t, err)
+			assert.Equal(t, "read msg", strconv.Itoa(i), string(b))
+		}
+		_, _, err := c2.Read(tt.ctx)
+		assert.Equal(t, "close status", websocket.StatusNormalClosure, websocket.CloseStatus(err))
+		assert.Success(t, <-errc)
+	})
+
+	t.Run("gracefulClose", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c2.CloseRead(tt.ctx)
+		errc := xsync.Go(func() error {
+			return c2.Close(websocket.StatusNormalClosure, "")
+		})
+
+		_, _, err := c1.Read(tt.ctx)
+		assert.Equal(t, "close status", websocket.StatusNormalClosure, websocket.CloseStatus(err))
+		assert.Success(t, <-errc)
+	})
+
+	t.Run("abnormalClose", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		err := c2.NetConn().Close()
+		assert.Success(t, err)
+
+		_, _, err = c1.Read(tt.ctx)
+		assert.Equal(t, "close status", websocket.StatusAbnormalClosure, websocket.CloseStatus(err))
+		assert.Equal(t, "errors.Is(err, io.EOF)", true, errors.Is(err, io.EOF))
+	})
+
+	t.Run("netConn", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		n1 := websocket.NetConn(tt.ctx, c1, websocket.MessageBinary)
+		n2 := websocket.NetConn(tt.ctx, c2, websocket.MessageBinary)
+
+		// Does not give any confidence but at least ensures no crashes.
+		d, _ := tt.ctx.Deadline()
+		n1.SetDeadline(d)
+		n1.SetDeadline(time.Time{})
+
+		assert.Equal(t, "remote addr", n1.RemoteAddr(), n1.LocalAddr())
+		assert.Equal(t, "remote addr string", "websocket/unknown-addr", n1.RemoteAddr().String())
+		assert.Equal(t, "remote addr network", "websocket", n1.RemoteAddr().Network())
+
+		errs := xsync.Go(func() error {
+			_, err := n2.Write([]byte("hello"))
+			if err != nil {
+				return err
+			}
+			return n2.Close()
+		})
+
+		b, err := ioutil.ReadAll(n1)
+		assert.Success(t, err)
+
+		_, err = n1.Read(nil)
+		assert.Equal(t, "read error", err, io.EOF)
+
+		select {
+		case err := <-errs:
+			assert.Success(t, err)
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+
+		assert.Equal(t, "read msg", []byte("hello"), b)
+	})
+
+	t.Run("netConn/BadMsg", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		n1 := websocket.NetConn(tt.ctx, c1, websocket.MessageBinary)
+		n2 := websocket.NetConn(tt.ctx, c2, websocket.MessageText)
+
+		errs := xsync.Go(func() error {
+			_, err := n2.Write([]byte("hello"))
+			if err != nil {
+				return err
+			}
+			return nil
+		})
+
+		_, err := ioutil.ReadAll(n1)
+		assert.Contains(t, err, `unexpected frame type read (expected MessageBinary): MessageText`)
+
+		select {
+		case err := <-errs:
+			assert.Success(t, err)
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+	})
+
+	t.Run("netConn/keepAlive", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		pings := make(chan struct{}, 3)
+		c2.SetPingHandler(func(ctx context.Context, payload []byte) error {
+			select {
+			case pings <- struct{}{}:
+			default:
+			}
+			return nil
+		})
+
+		n1 := websocket.NetConnWithOptions(tt.ctx, c1, &websocket.NetConnOptions{
+			KeepAliveInterval: time.Millisecond * 10,
+		})
+		n2 := websocket.NetConn(tt.ctx, c2, websocket.MessageBinary)
+
+		// Reading the net.Conns receives the pings and pongs.
+		go io.Copy(ioutil.Discard, n1)
+		go io.Copy(ioutil.Discard, n2)
+
+		for i := 0; i < 3; i++ {
+			select {
+			case <-pings:
+			case <-tt.ctx.Done():
+				t.Fatal(tt.ctx.Err())
+			}
+		}
+
+		// The pings do not show up in the byte stream.
+		_, err := n1.Write([]byte("hello"))
+		assert.Success(t, err)
+
+		err = n1.Close()
+		assert.Success(t, err)
+	})
+
+	t.Run("netConn/keepAliveTimeout", func(t *testing.T) {
 		tt, c1, _ := newConnTest(t, nil, nil)
 		defer tt.cleanup()
 
-		err := c1.Close(-1, "")
-		assert.Contains(t, err, "failed to marshal close frame: status code StatusCode(-1) cannot be set")
+		n1 := websocket.NetConnWithOptions(tt.ctx, c1, &websocket.NetConnOptions{
+			KeepAliveInterval: time.Millisecond * 10,
+			KeepAliveTimeout:  time.Millisecond * 50,
+		})
+
+		// The peer never reads so the pong never arrives and the
+		// net.Conn is torn down.
+		_, err := n1.Read(make([]byte, 1))
+		assert.Error(t, err)
 	})
 
-	t.Run("ping", func(t *testing.T) {
+	t.Run("netConn/AcceptAnyType", func(t *testing.T) {
 		tt, c1, c2 := newConnTest(t, nil, nil)
 		defer tt.cleanup()
 
-		c1.CloseRead(tt.ctx)
+		n1 := websocket.NetConnWithOptions(tt.ctx, c1, &websocket.NetConnOptions{
+			AcceptAnyType: true,
+		})
+		n2 := websocket.NetConnWithOptions(tt.ctx, c2, &websocket.NetConnOptions{
+			MessageType: websocket.MessageText,
+		})
+
+		errs := xsync.Go(func() error {
+			_, err := n2.Write([]byte("hello"))
+			if err != nil {
+				return err
+			}
+			err = c2.Write(tt.ctx, websocket.MessageBinary, []byte(" world"))
+			if err != nil {
+				return err
+			}
+			return n2.Close()
+		})
+
+		b, err := ioutil.ReadAll(n1)
+		assert.Success(t, err)
+		assert.Equal(t, "read msg", "hello world", string(b))
+
+		select {
+		case err := <-errs:
+			assert.Success(t, err)
+		case <-tt.ctx.Done():
+			t.Fatal(tt.ctx.Err())
+		}
+	})
+
+	t.Run("peekMessage", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		werr := xsync.Go(func() error {
+			w, err := c2.Writer(tt.ctx, websocket.MessageBinary)
+			if err != nil {
+				return err
+			}
+			// Each write is a separate frame.
+			for _, p := range []string{"ab", "cd", "efgh"} {
+				_, err = w.Write([]byte(p))
+				if err != nil {
+					return err
+				}
+			}
+			err = w.Close()
+			if err != nil {
+				return err
+			}
+			return c2.Write(tt.ctx, websocket.MessageText, []byte("xy"))
+		})
+
+		_, _, _, err := c1.PeekMessage(tt.ctx, -1)
+		assert.Contains(t, err, "negative length")
+
+		typ, p, r, err := c1.PeekMessage(tt.ctx, 3)
+		assert.Success(t, err)
+		assert.Equal(t, "message type", websocket.MessageBinary, typ)
+		assert.Equal(t, "peeked", "abc", string(p))
+
+		b, err := ioutil.ReadAll(r)
+		assert.Success(t, err)
+		assert.Equal(t, "rest", "defgh", string(b))
+
+		// Only what is read is allocated, even without a read limit.
+		c1.SetReadLimit(-1)
+		typ, p, r, err = c1.PeekMessage(tt.ctx, int(^uint(0)>>1))
+		assert.Success(t, err)
+		assert.Equal(t, "message type", websocket.MessageText, typ)
+		assert.Equal(t, "peeked", "xy", string(p))
+
+		b, err = ioutil.ReadAll(r)
+		assert.Success(t, err)
+		assert.Equal(t, "rest", "", string(b))
+
+		assert.Success(t, <-werr)
+
 		c2.CloseRead(tt.ctx)
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
 
-		for i := 0; i < 10; i++ {
-			err := c1.Ping(tt.ctx)
+	t.Run("writeFrom", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c1.SetReadLimit(-1)
+		c2.SetReadLimit(-1)
+		tt.goEchoLoop(c2)
+
+		// A reader failing straight away abandons the message.
+		_, err := c1.WriteFrom(tt.ctx, websocket.MessageBinary, errReader{errors.New("boom")})
+		assert.Contains(t, err, "failed to read msg")
+
+		msg := xrand.Bytes(100000)
+		werr := xsync.Go(func() error {
+			n, err := c1.WriteFrom(tt.ctx, websocket.MessageBinary, bytes.NewReader(msg))
+			if err != nil {
+				return err
+			}
+			if n != int64(len(msg)) {
+				return fmt.Errorf("unexpected bytes written: %v", n)
+			}
+			return nil
+		})
+
+		typ, b, err := c1.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "type", websocket.MessageBinary, typ)
+		assert.Equal(t, "msg", msg, b)
+		assert.Success(t, <-werr)
+
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("writeFrom/readError", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		werr := xsync.Go(func() error {
+			r := io.MultiReader(bytes.NewReader(xrand.Bytes(100)), errReader{errors.New("boom")})
+			_, err := c1.WriteFrom(tt.ctx, websocket.MessageBinary, iotest.OneByteReader(r))
+			return err
+		})
+
+		_, _, err := c2.Read(tt.ctx)
+		assert.Equal(t, "close status", websocket.StatusInternalError, websocket.CloseStatus(err))
+		assert.Contains(t, <-werr, "failed to read msg")
+	})
+
+	t.Run("nextMessageType", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c2.CloseRead(tt.ctx)
+
+		werr := xsync.Go(func() error {
+			// Answered by c1 while it waits for the message.
+			err := c2.Ping(tt.ctx)
+			if err != nil {
+				return err
+			}
+			err = c2.Write(tt.ctx, websocket.MessageText, []byte("hi"))
+			if err != nil {
+				return err
+			}
+			return c2.Write(tt.ctx, websocket.MessageBinary, []byte{1, 2, 3})
+		})
+
+		for i := 0; i < 2; i++ {
+			typ, err := c1.NextMessageType(tt.ctx)
 			assert.Success(t, err)
+			assert.Equal(t, "type", websocket.MessageText, typ)
 		}
 
-		err := c1.Close(websocket.StatusNormalClosure, "")
+		typ, b, err := c1.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "type", websocket.MessageText, typ)
+		assert.Equal(t, "msg", "hi", string(b))
+
+		typ, err = c1.NextMessageType(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "type", websocket.MessageBinary, typ)
+
+		typ, b, err = c1.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "type", websocket.MessageBinary, typ)
+		assert.Equal(t, "msg", []byte{1, 2, 3}, b)
+		assert.Success(t, <-werr)
+
+		err = c1.Close(websocket.StatusNormalClosure, "")
 		assert.Success(t, err)
 	})
 
-	t.Run("badPing", func(t *testing.T) {
+	t.Run("skipMessage", func(t *testing.T) {
 		tt, c1, c2 := newConnTest(t, nil, nil)
 		defer tt.cleanup()
 
+		werr := xsync.Go(func() error {
+			for _, p := range []string{"skip me", "skip me too", "keep me"} {
+				err := c2.Write(tt.ctx, websocket.MessageText, []byte(p))
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		_, p, _, err := c1.PeekMessage(tt.ctx, 4)
+		assert.Success(t, err)
+		assert.Equal(t, "peeked", "skip", string(p))
+
+		// Skips the rest of the peeked message.
+		err = c1.SkipMessage(tt.ctx)
+		assert.Success(t, err)
+		// Skips the next message entirely.
+		err = c1.SkipMessage(tt.ctx)
+		assert.Success(t, err)
+
+		_, b, err := c1.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "msg", "keep me", string(b))
+		assert.Success(t, <-werr)
+
+		// The CloseRead goroutine owns the reader now.
+		c1.CloseRead(tt.ctx)
+		err = c1.SkipMessage(tt.ctx)
+		assert.Contains(t, err, "read closed")
+
 		c2.CloseRead(tt.ctx)
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
 
-		ctx, cancel := context.WithTimeout(tt.ctx, time.Millisecond*100)
-		defer cancel()
+	t.Run("readLimit", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
 
-		err := c1.Ping(ctx)
-		assert.Contains(t, err, "failed to wait for pong")
+		tt.goEchoLoop(c2)
+
+		assert.Equal(t, "default read limit", int64(32768), c1.ReadLimit())
+		c1.SetReadLimit(-1)
+		assert.Equal(t, "read limit", int64(-1), c1.ReadLimit())
+
+		msg := xrand.Bytes(65536)
+		werr := xsync.Go(func() error {
+			return c1.Write(tt.ctx, websocket.MessageBinary, msg)
+		})
+
+		_, r, err := c1.Reader(tt.ctx)
+		assert.Success(t, err)
+
+		// Lowering the limit must not abort the message in flight.
+		c1.SetReadLimit(10)
+
+		b, err := ioutil.ReadAll(r)
+		assert.Success(t, err)
+		assert.Equal(t, "read msg", msg, b)
+		assert.Success(t, <-werr)
+
+		assert.Equal(t, "read limit", int64(10), c1.ReadLimit())
+
+		msg = xrand.Bytes(10)
+		err = c1.Write(tt.ctx, websocket.MessageBinary, msg)
+		assert.Success(t, err)
+
+		_, b, err = c1.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "read msg", msg, b)
+
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
 	})
 
-	t.Run("concurrentWrite", func(t *testing.T) {
+	t.Run("readLimitExceeded", func(t *testing.T) {
 		tt, c1, c2 := newConnTest(t, nil, nil)
 		defer tt.cleanup()
 
-		tt.goDiscardLoop(c2)
+		c2.CloseRead(tt.ctx)
+		c1.SetReadLimit(10)
 
-		msg := xrand.Bytes(xrand.Int(9999))
-		const count = 100
-		errs := make(chan error, count)
+		msg := xrand.Bytes(64)
+		werr := xsync.Go(func() error {
+			return c2.Write(tt.ctx, websocket.MessageBinary, msg)
+		})
 
-		for i := 0; i < count; i++ {
-			go func() {
-				select {
-				case errs <- c1.Write(tt.ctx, websocket.MessageBinary, msg):
-				case <-tt.ctx.Done():
-					return
-				}
-			}()
+		_, b, err := c1.Read(tt.ctx)
+		if !errors.Is(err, websocket.ErrReadLimitExceeded) {
+			t.Fatalf("expected ErrReadLimitExceeded: %+v", err)
+		}
+		assert.Contains(t, err, "read limited at 10 bytes")
+		if len(b) < 10 {
+			t.Fatalf("expected at least 10 bytes of the message: %v", len(b))
 		}
+		assert.Equal(t, "partial msg", msg[:len(b)], b)
 
-		for i := 0; i < count; i++ {
-			select {
-			case err := <-errs:
-				assert.Success(t, err)
-			case <-tt.ctx.Done():
-				t.Fatal(tt.ctx.Err())
-			}
+		// The connection is closed so the write may or may not succeed.
+		<-werr
+	})
+
+	t.Run("json", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		tt.goEchoLoop(c2)
+
+		exp := map[string]interface{}{
+			"hello": "world",
 		}
 
-		err := c1.Close(websocket.StatusNormalClosure, "")
+		err := c1.WriteJSON(tt.ctx, exp)
+		assert.Success(t, err)
+
+		var act map[string]interface{}
+		err = c1.ReadJSON(tt.ctx, &act)
+		assert.Success(t, err)
+		assert.Equal(t, "read msg", exp, act)
+
+		err = c1.Close(websocket.StatusNormalClosure, "")
 		assert.Success(t, err)
 	})
 
-	t.Run("concurrentWriteError", func(t *testing.T) {
-		tt, c1, _ := newConnTest(t, nil, nil)
+	t.Run("blocking", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		tt.goEchoLoop(c2)
+
+		err := c1.WriteBlocking(websocket.MessageText, []byte("hello"))
+		assert.Success(t, err)
+
+		typ, b, err := c1.ReadBlocking()
+		assert.Success(t, err)
+		assert.Equal(t, "read type", websocket.MessageText, typ)
+		assert.Equal(t, "read msg", "hello", string(b))
+
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("exchange", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
 		defer tt.cleanup()
 
-		_, err := c1.Writer(tt.ctx, websocket.MessageText)
+		serr := xsync.Go(func() error {
+			_, req, err := c2.Read(tt.ctx)
+			if err != nil {
+				return err
+			}
+			err = c2.Write(tt.ctx, websocket.MessageText, append([]byte("re: "), req...))
+			if err != nil {
+				return err
+			}
+			_, _, err = c2.Read(tt.ctx)
+			if err != nil {
+				return err
+			}
+			return c2.Close(websocket.StatusGoingAway, "bye")
+		})
+
+		typ, resp, err := c1.Exchange(tt.ctx, websocket.MessageBinary, []byte("hi"))
 		assert.Success(t, err)
+		assert.Equal(t, "reply type", websocket.MessageText, typ)
+		assert.Equal(t, "reply", "re: hi", string(resp))
 
-		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
-		defer cancel()
+		// The peer closes instead of replying.
+		_, _, err = c1.Exchange(tt.ctx, websocket.MessageBinary, []byte("hi"))
+		assert.Contains(t, err, "failed to read reply")
+		assert.Equal(t, "close status", websocket.StatusGoingAway, websocket.CloseStatus(err))
 
-		err = c1.Write(ctx, websocket.MessageText, []byte("x"))
-		assert.Equal(t, "write error", context.DeadlineExceeded, err)
+		assert.Success(t, <-serr)
 	})
 
-	t.Run("netConn", func(t *testing.T) {
-		tt, c1, c2 := newConnTest(t, nil, nil)
-		defer tt.cleanup()
+	t.Run("closeDuringWrite", func(t *testing.T) {
+		t.Parallel()
 
-		n1 := websocket.NetConn(tt.ctx, c1, websocket.MessageBinary)
-		n2 := websocket.NetConn(tt.ctx, c2, websocket.MessageBinary)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
 
-		// Does not give any confidence but at least ensures no crashes.
-		d, _ := tt.ctx.Deadline()
-		n1.SetDeadline(d)
-		n1.SetDeadline(time.Time{})
+		c1, c2 := wstest.Pipe(nil, nil)
+		defer c2.Close(websocket.StatusInternalError, "")
+		defer c1.Close(websocket.StatusInternalError, "")
 
-		assert.Equal(t, "remote addr", n1.RemoteAddr(), n1.LocalAddr())
-		assert.Equal(t, "remote addr string", "websocket/unknown-addr", n1.RemoteAddr().String())
-		assert.Equal(t, "remote addr network", "websocket", n1.RemoteAddr().Network())
+		c1.CloseRead(ctx)
 
-		errs := xsync.Go(func() error {
-			_, err := n2.Write([]byte("hello"))
+		// The server closes while the client is busy writing.
+		cerr := xsync.Go(func() error {
+			_, _, err := c2.Read(ctx)
 			if err != nil {
 				return err
 			}
-			return n2.Close()
+			return c2.Close(websocket.StatusGoingAway, "shutting down")
 		})
 
-		b, err := ioutil.ReadAll(n1)
-		assert.Success(t, err)
-
-		_, err = n1.Read(nil)
-		assert.Equal(t, "read error", err, io.EOF)
-
-		select {
-		case err := <-errs:
-			assert.Success(t, err)
-		case <-tt.ctx.Done():
-			t.Fatal(tt.ctx.Err())
+		msg := xrand.Bytes(1024)
+		var err error
+		for err == nil {
+			err = c1.Write(ctx, websocket.MessageBinary, msg)
 		}
-
-		assert.Equal(t, "read msg", []byte("hello"), b)
+		code, reason, ok := websocket.CloseReason(err)
+		if !ok {
+			t.Fatalf("expected close error: %+v", err)
+		}
+		assert.Equal(t, "close status", websocket.StatusGoingAway, code)
+		assert.Equal(t, "close reason", "shutting down", reason)
+		assert.Success(t, <-cerr)
 	})
 
-	t.Run("netConn/BadMsg", func(t *testing.T) {
-		tt, c1, c2 := newConnTest(t, nil, nil)
-		defer tt.cleanup()
+	t.Run("broadcast", func(t *testing.T) {
+		t.Parallel()
 
-		n1 := websocket.NetConn(tt.ctx, c1, websocket.MessageBinary)
-		n2 := websocket.NetConn(tt.ctx, c2, websocket.MessageText)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
 
-		errs := xsync.Go(func() error {
-			_, err := n2.Write([]byte("hello"))
-			if err != nil {
-				return err
+		var conns []*websocket.Conn
+		var reads []<-chan error
+		for i := 0; i < 3; i++ {
+			c1, c2 := wstest.Pipe(nil, nil)
+			defer c2.Close(websocket.StatusInternalError, "")
+			defer c1.Close(websocket.StatusInternalError, "")
+			conns = append(conns, c1)
+
+			if i == 1 {
+				// Never reads so the write cannot complete.
+				continue
 			}
-			return nil
-		})
+			reads = append(reads, xsync.Go(func() error {
+				_, b, err := c2.Read(ctx)
+				if err != nil {
+					return err
+				}
+				if string(b) != "hello" {
+					return fmt.Errorf("unexpected msg: %q", b)
+				}
+				c2.CloseRead(ctx)
+				return nil
+			}))
+		}
 
-		_, err := ioutil.ReadAll(n1)
-		assert.Contains(t, err, `unexpected frame type read (expected MessageBinary): MessageText`)
+		conns = append(conns, nil)
+		errs := websocket.Broadcast(ctx, conns, websocket.MessageText, []byte("hello"), time.Millisecond*200)
+		assert.Equal(t, "errs", 4, len(errs))
+		assert.Success(t, errs[0])
+		assert.Contains(t, errs[1], "context deadline exceeded")
+		assert.Success(t, errs[2])
+		assert.Contains(t, errs[3], "nil connection")
 
-		select {
-		case err := <-errs:
-			assert.Success(t, err)
-		case <-tt.ctx.Done():
-			t.Fatal(tt.ctx.Err())
+		for _, rerr := range reads {
+			assert.Success(t, <-rerr)
 		}
 	})
 
@@ -246,6 +1817,34 @@ func TestConn(t *testing.T) {
 		assert.Success(t, err)
 	})
 
+	t.Run("wsjson/Stream", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		werr := xsync.Go(func() error {
+			for i := 0; i < 3; i++ {
+				err := wsjson.Write(tt.ctx, c2, i)
+				if err != nil {
+					return err
+				}
+			}
+			return c2.Close(websocket.StatusNormalClosure, "")
+		})
+
+		var msgs []string
+		var err error
+		for res := range wsjson.Stream(tt.ctx, c1) {
+			if res.Err != nil {
+				err = res.Err
+				continue
+			}
+			msgs = append(msgs, strings.TrimSpace(string(res.Msg)))
+		}
+		assert.Equal(t, "msgs", []string{"0", "1", "2"}, msgs)
+		assert.Equal(t, "close status", websocket.StatusNormalClosure, websocket.CloseStatus(err))
+		assert.Success(t, <-werr)
+	})
+
 	t.Run("wspb", func(t *testing.T) {
 		tt, c1, c2 := newConnTest(t, nil, nil)
 		defer tt.cleanup()
@@ -264,6 +1863,133 @@ func TestConn(t *testing.T) {
 		err = c1.Close(websocket.StatusNormalClosure, "")
 		assert.Success(t, err)
 	})
+
+	t.Run("wspb/stream", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c1.SetReadLimit(-1)
+		c2.SetReadLimit(-1)
+		tt.goEchoLoop(c2)
+
+		// Large enough to be written in many frames.
+		exp := &structpb.ListValue{}
+		for i := 0; i < 16384; i++ {
+			exp.Values = append(exp.Values, &structpb.Value{
+				Kind: &structpb.Value_NumberValue{NumberValue: float64(i)},
+			})
+		}
+
+		werr := xsync.Go(func() error {
+			return wspb.WriteStream(tt.ctx, c1, exp)
+		})
+
+		act := &structpb.ListValue{}
+		err := wspb.ReadStream(tt.ctx, c1, act)
+		assert.Success(t, err)
+		assert.Equal(t, "read msg", exp, act)
+		assert.Success(t, <-werr)
+
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("wspb/delimitedWriteAfterClose", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		tt.goEchoLoop(c2)
+
+		w, err := wspb.NewDelimitedWriter(tt.ctx, c1)
+		assert.Success(t, err)
+		err = w.Close()
+		assert.Success(t, err)
+
+		err = w.Write(&structpb.Value{})
+		assert.Contains(t, err, "cannot use closed writer")
+
+		_, b, err := c1.Read(tt.ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "read msg", "", string(b))
+
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
+
+	t.Run("wspb/delimitedMarshalError", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c2.CloseRead(tt.ctx)
+
+		err := wspb.WriteDelimited(tt.ctx, c1, &structpb.Value{
+			Kind: &structpb.Value_StringValue{StringValue: "\xff"},
+		})
+		assert.Contains(t, err, "failed to marshal protobuf")
+
+		// The message could not be finished so the connection is closed
+		// instead of leaving later writes blocked.
+		err = c1.Write(tt.ctx, websocket.MessageBinary, []byte("hi"))
+		assert.Equal(t, "close status", websocket.StatusInternalError, websocket.CloseStatus(err))
+	})
+
+	t.Run("wspb/delimitedBadLength", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c2.CloseRead(tt.ctx)
+
+		b := make([]byte, binary.MaxVarintLen64)
+		b = b[:binary.PutUvarint(b, 1<<63)]
+		werr := xsync.Go(func() error {
+			return c2.Write(tt.ctx, websocket.MessageBinary, b)
+		})
+
+		r, err := wspb.NewDelimitedReader(tt.ctx, c1)
+		assert.Success(t, err)
+		err = r.Read(&structpb.Value{})
+		assert.Contains(t, err, "invalid protobuf length")
+		assert.Success(t, <-werr)
+	})
+
+	t.Run("wspb/delimited", func(t *testing.T) {
+		tt, c1, c2 := newConnTest(t, nil, nil)
+		defer tt.cleanup()
+
+		c1.SetReadLimit(-1)
+		c2.SetReadLimit(-1)
+		tt.goEchoLoop(c2)
+
+		exp := make([]*structpb.ListValue, 3)
+		for i := range exp {
+			exp[i] = &structpb.ListValue{}
+			for j := 0; j < 4096; j++ {
+				exp[i].Values = append(exp[i].Values, &structpb.Value{
+					Kind: &structpb.Value_NumberValue{NumberValue: float64(i * j)},
+				})
+			}
+		}
+
+		werr := xsync.Go(func() error {
+			return wspb.WriteDelimited(tt.ctx, c1, exp[0], exp[1], exp[2])
+		})
+
+		r, err := wspb.NewDelimitedReader(tt.ctx, c1)
+		assert.Success(t, err)
+
+		for i := range exp {
+			act := &structpb.ListValue{}
+			err = r.Read(act)
+			assert.Success(t, err)
+			assert.Equal(t, "read msg", exp[i], act)
+		}
+		err = r.Read(&structpb.ListValue{})
+		assert.Equal(t, "final read", io.EOF, err)
+		assert.Success(t, <-werr)
+
+		err = c1.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+	})
 }
 
 func TestWasm(t *testing.T) {
@@ -527,3 +2253,212 @@ func TestGin(t *testing.T) {
 	err = c.Close(websocket.StatusNormalClosure, "")
 	assert.Success(t, err)
 }
+
+func TestAcceptClose(t *testing.T) {
+	t.Parallel()
+
+	serr := make(chan error, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			serr <- err
+			return
+		}
+		serr <- c.Close(websocket.StatusPolicyViolation, "unauthorized")
+	}))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	c, _, err := websocket.Dial(ctx, s.URL, nil)
+	assert.Success(t, err)
+	defer c.Close(websocket.StatusInternalError, "")
+
+	_, _, err = c.Read(ctx)
+	assert.Equal(t, "close status", websocket.StatusPolicyViolation, websocket.CloseStatus(err))
+	var ce websocket.CloseError
+	if errors.As(err, &ce) {
+		assert.Equal(t, "close reason", "unauthorized", ce.Reason)
+	}
+	assert.Success(t, <-serr)
+}
+
+func TestAbnormalClosureTCP(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		// Drop the TCP connection without a close frame.
+		c.NetConn().Close()
+	}))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	c, _, err := websocket.Dial(ctx, s.URL, nil)
+	assert.Success(t, err)
+	defer c.Close(websocket.StatusInternalError, "")
+
+	_, _, err = c.Read(ctx)
+	assert.Equal(t, "close status", websocket.StatusAbnormalClosure, websocket.CloseStatus(err))
+	assert.Equal(t, "errors.Is(err, io.EOF)", true, errors.Is(err, io.EOF))
+}
+
+func TestReconnectingConn(t *testing.T) {
+	t.Parallel()
+
+	t.Run("reconnect", func(t *testing.T) {
+		t.Parallel()
+
+		var conns int32
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c, err := websocket.Accept(w, r, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer c.Close(websocket.StatusInternalError, "")
+
+			// The first connection is dropped as if the server restarted.
+			if atomic.AddInt32(&conns, 1) == 1 {
+				c.Close(websocket.StatusGoingAway, "restarting")
+				return
+			}
+
+			err = c.Write(r.Context(), websocket.MessageText, []byte("hello"))
+			if err != nil {
+				return
+			}
+			wstest.EchoLoop(r.Context(), c)
+		}))
+		defer s.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		var onConnects int32
+		states := make(chan websocket.ReconnectState, 8)
+		rc, err := websocket.DialReconnecting(ctx, s.URL, &websocket.ReconnectOptions{
+			OnConnect: func(ctx context.Context, c *websocket.Conn) error {
+				atomic.AddInt32(&onConnects, 1)
+				return nil
+			},
+			OnStateChange: func(state websocket.ReconnectState, err error) {
+				states <- state
+			},
+			MinBackoff: time.Millisecond * 10,
+		})
+		assert.Success(t, err)
+		defer rc.Close(websocket.StatusInternalError, "")
+
+		_, p, err := rc.Read(ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "msg", "hello", string(p))
+
+		err = rc.Write(ctx, websocket.MessageText, []byte("echo"))
+		assert.Success(t, err)
+		_, p, err = rc.Read(ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "msg", "echo", string(p))
+
+		assert.Equal(t, "OnConnect calls", int32(2), atomic.LoadInt32(&onConnects))
+
+		err = rc.Close(websocket.StatusNormalClosure, "")
+		assert.Success(t, err)
+		act := []websocket.ReconnectState{<-states, <-states, <-states}
+		assert.Equal(t, "states", []websocket.ReconnectState{
+			websocket.ReconnectConnecting,
+			websocket.ReconnectConnected,
+			websocket.ReconnectClosed,
+		}, act)
+
+		_, _, err = rc.Read(ctx)
+		assert.Contains(t, err, "ReconnectingConn closed")
+	})
+
+	t.Run("maxAttempts", func(t *testing.T) {
+		t.Parallel()
+
+		var conns int32
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&conns, 1) > 1 {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			c, err := websocket.Accept(w, r, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			c.Close(websocket.StatusGoingAway, "")
+		}))
+		defer s.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+		defer cancel()
+
+		rc, err := websocket.DialReconnecting(ctx, s.URL, &websocket.ReconnectOptions{
+			MinBackoff:  time.Millisecond * 10,
+			MaxAttempts: 2,
+		})
+		assert.Success(t, err)
+		defer rc.Close(websocket.StatusInternalError, "")
+
+		_, _, err = rc.Read(ctx)
+		assert.Contains(t, err, "failed to reconnect after 2 attempts")
+		assert.Equal(t, "dials", int32(3), atomic.LoadInt32(&conns))
+	})
+}
+
+func TestConnNetConn(t *testing.T) {
+	t.Parallel()
+
+	serverAddr := make(chan net.Addr, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close(websocket.StatusInternalError, "")
+
+		serverAddr <- c.NetConn().LocalAddr()
+
+		ctx := c.CloseRead(r.Context())
+		<-ctx.Done()
+	}))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	c, _, err := websocket.Dial(ctx, s.URL, nil)
+	assert.Success(t, err)
+	defer c.Close(websocket.StatusInternalError, "")
+
+	nc, ok := c.NetConn().(*net.TCPConn)
+	if !ok {
+		t.Fatalf("expected *net.TCPConn: %T", c.NetConn())
+	}
+	err = nc.SetNoDelay(true)
+	assert.Success(t, err)
+
+	assert.Equal(t, "server addr", (<-serverAddr).String(), nc.RemoteAddr().String())
+
+	err = c.Close(websocket.StatusNormalClosure, "")
+	assert.Success(t, err)
+}
+
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read(p []byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,9 @@
+// +build go1.20
+
+package websocket
+
+import "context"
+
+func withCancelCause(parent context.Context) (context.Context, func(error)) {
+	return context.WithCancelCause(parent)
+}
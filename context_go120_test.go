@@ -0,0 +1,43 @@
+// +build go1.20,!js
+
+package websocket_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/internal/test/assert"
+	"nhooyr.io/websocket/internal/test/wstest"
+)
+
+func TestConnContext(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	c1, c2 := wstest.Pipe(nil, nil)
+	defer c2.Close(websocket.StatusInternalError, "")
+	defer c1.Close(websocket.StatusInternalError, "")
+
+	cctx := c2.Context()
+	select {
+	case <-cctx.Done():
+		t.Fatal("context done before close")
+	default:
+	}
+
+	c2.CloseRead(ctx)
+	err := c1.Close(websocket.StatusGoingAway, "bye")
+	assert.Success(t, err)
+
+	select {
+	case <-cctx.Done():
+	case <-ctx.Done():
+		t.Fatal("context not done after close")
+	}
+	assert.Equal(t, "err", context.Canceled, cctx.Err())
+	assert.Equal(t, "cause status", websocket.StatusGoingAway, websocket.CloseStatus(context.Cause(cctx)))
+}
@@ -0,0 +1,11 @@
+// +build !go1.20
+
+package websocket
+
+import "context"
+
+// context.Cause is unavailable so the cause is dropped.
+func withCancelCause(parent context.Context) (context.Context, func(error)) {
+	ctx, cancel := context.WithCancel(parent)
+	return ctx, func(error) { cancel() }
+}
@@ -12,7 +12,9 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"strings"
 	"sync"
@@ -29,8 +31,30 @@ type DialOptions struct {
 	HTTPClient *http.Client
 
 	// HTTPHeader specifies the HTTP headers included in the handshake request.
+	// They are sent as is, including multiple values for a key, except for the
+	// headers set by the handshake itself such as Upgrade and Sec-WebSocket-Key
+	// which are overwritten.
 	HTTPHeader http.Header
 
+	// Host overrides the Host header of the handshake request, e.g. to reach a
+	// virtual host when dialing an IP address. The connection is still made to,
+	// and for wss URLs TLS verified against, the host of the URL.
+	Host string
+
+	// Proxy returns the proxy to use for the handshake request.
+	// If it returns a nil *url.URL, no proxy is used.
+	//
+	// Defaults to the Proxy of the HTTPClient's *http.Transport which
+	// is http.ProxyFromEnvironment for http.DefaultTransport.
+	//
+	// With an http or https proxy, the connection is tunneled through
+	// the proxy with a CONNECT request for both ws and wss so that the
+	// proxy never sees the WebSocket handshake. Credentials in the proxy
+	// URL are sent with basic auth in the Proxy-Authorization header.
+	//
+	// Only applies when the HTTPClient's Transport is an *http.Transport.
+	Proxy func(*http.Request) (*url.URL, error)
+
 	// Subprotocols lists the WebSocket subprotocols to negotiate with the server.
 	Subprotocols []string
 
@@ -45,6 +69,120 @@ type DialOptions struct {
 	// Defaults to 512 bytes for CompressionNoContextTakeover and 128 bytes
 	// for CompressionContextTakeover.
 	CompressionThreshold int
+
+	// CompressionFallback makes Write send a message uncompressed if compressing
+	// it would not make it smaller, e.g. for already compressed data. The message
+	// is compressed into a buffer first to compare the sizes.
+	//
+	// It only applies to Write as a message streamed with Writer is compressed
+	// and written frame by frame. See Conn.Stats for how often it triggers.
+	CompressionFallback bool
+
+	// CompressionDictionary seeds the compression dictionary of every connection
+	// so that messages sharing a common prefix, e.g. a fixed JSON envelope,
+	// compress well from the very first message. Only the last 8192 bytes are
+	// used when compressing.
+	//
+	// Both peers must be configured with the same dictionary out of band as
+	// there is no way to negotiate it. A mismatched dictionary results in
+	// corrupt or failed decompression.
+	//
+	// With CompressionNoContextTakeover, every message starts from the dictionary.
+	CompressionDictionary []byte
+
+	// CloseHandshakeTimeout bounds both writing a close frame and waiting
+	// for the peer's close frame in reply during the close handshake.
+	//
+	// Defaults to 5s. A negative value disables the timeout so that only
+	// the connection closing bounds the close handshake.
+	CloseHandshakeTimeout time.Duration
+
+	// WriteQueueSize enables a bounded write queue when positive.
+	//
+	// Write will then copy the message into the queue and return immediately
+	// instead of waiting for it to be written. A single goroutine writes queued
+	// messages to the connection in order. If the queue is full, Write returns
+	// ErrWriteQueueFull. Errors writing a queued message close the connection.
+	//
+	// Close writes the messages still queued before the close frame. If that
+	// takes longer than CloseHandshakeTimeout, the messages still queued are
+	// dropped and never written.
+	//
+	// Writer is unaffected and still writes directly to the connection.
+	WriteQueueSize int
+
+	// DisableMasking disables masking of the frames written by the client.
+	//
+	// WARNING: This violates RFC 6455 which requires clients to mask every frame.
+	// Compliant servers, including Accept in this package, will reject the connection.
+	// Masking protects intermediaries from cache poisoning attacks so never use this
+	// against untrusted servers or over untrusted networks. It is only meant for interop
+	// testing and measuring the masking overhead in controlled environments.
+	DisableMasking bool
+
+	// SecWebSocketKey sets the Sec-WebSocket-Key of the handshake request
+	// instead of generating a random one. It must be 16 base64 encoded bytes.
+	//
+	// WARNING: This is only meant for tests that replay a recorded handshake
+	// and need it to be reproducible. The key must be fresh and random for
+	// every dial otherwise, so leave it unset outside of tests.
+	SecWebSocketKey string
+
+	// ReadBufferSize and WriteBufferSize set the size of the buffers used to
+	// read from and write to the connection. Larger buffers reduce syscalls when
+	// streaming large messages while smaller buffers reduce memory usage.
+	//
+	// Both default to 4096 bytes. ReadBufferSize has a minimum of 16 bytes.
+	ReadBufferSize  int
+	WriteBufferSize int
+
+	// MaxFragments limits the number of frames a single message read from the
+	// peer may be fragmented into. A message exceeding it closes the connection
+	// with StatusProtocolError. This protects against fragmentation floods of
+	// tiny frames that stay within the read limit.
+	//
+	// Defaults to 0 which means unlimited.
+	MaxFragments int
+
+	// MaxWireFrameSize limits the payload length of a single data frame read
+	// from the peer as sent on the wire, i.e. before any decompression. A frame
+	// exceeding it closes the connection with StatusMessageTooBig before any of
+	// its payload is read.
+	//
+	// Unlike SetReadLimit which bounds the decompressed size of a message, this
+	// bounds the compressed size so the two can be tuned independently.
+	//
+	// Defaults to 0 which means unlimited.
+	MaxWireFrameSize int64
+
+	// OnWriteProgress and OnReadProgress are called with the total number of
+	// uncompressed bytes of the current message written or read so far, e.g.
+	// to render a progress bar when streaming a large message.
+	//
+	// OnWriteProgress is called once the data passed to Write, or to each Write
+	// of a Writer, has been written to the connection as frames. OnReadProgress
+	// is called after every read of the message that returns data.
+	//
+	// They are called without the frame locks held so pings and pongs are not
+	// held up but they block the write or read they report on until they return.
+	OnWriteProgress func(written int64)
+	OnReadProgress  func(read int64)
+
+	// OnMessageWritten is called after the fin frame of every data message
+	// written has been sent with the size of the message and the total payload
+	// size of its frames on the wire. They are equal unless the message was
+	// compressed, so comparing them shows whether compression is worthwhile,
+	// e.g. to tune CompressionThreshold.
+	OnMessageWritten func(typ MessageType, uncompressed, wire int)
+
+	// OnError is called once with the originating error when the connection
+	// fails, e.g. a write of a pong or close frame failing, a read timing out
+	// or the connection dropping, rather than being closed with a close handshake
+	// or a close frame from the peer. This lets the failure be logged as it
+	// happens instead of on the next Read or Write.
+	//
+	// It is called in a goroutine of its own so it may use the connection.
+	OnError func(err error)
 }
 
 // Dial performs a WebSocket handshake on url.
@@ -79,9 +217,9 @@ func dial(ctx context.Context, urls string, opts *DialOptions, rand io.Reader) (
 		opts.HTTPHeader = http.Header{}
 	}
 
-	secWebSocketKey, err := secWebSocketKey(rand)
+	secWebSocketKey, err := dialSecWebSocketKey(opts, rand)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to generate Sec-WebSocket-Key: %w", err)
+		return nil, nil, err
 	}
 
 	var copts *compressionOptions
@@ -89,6 +227,13 @@ func dial(ctx context.Context, urls string, opts *DialOptions, rand io.Reader) (
 		copts = opts.CompressionMode.opts()
 	}
 
+	var netConn net.Conn
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			netConn = info.Conn
+		},
+	})
+
 	resp, err := handshakeRequest(ctx, urls, opts, copts, secWebSocketKey)
 	if err != nil {
 		return nil, resp, err
@@ -120,15 +265,132 @@ func dial(ctx context.Context, urls string, opts *DialOptions, rand io.Reader) (
 	if !ok {
 		return nil, resp, fmt.Errorf("response body is not a io.ReadWriteCloser: %T", respBody)
 	}
+	if netConn == nil {
+		netConn, _ = rwc.(net.Conn)
+	}
 
 	return newConn(connConfig{
 		subprotocol:    resp.Header.Get("Sec-WebSocket-Protocol"),
+		extensions:     resp.Header.Get("Sec-WebSocket-Extensions"),
 		rwc:            rwc,
+		netConn:        netConn,
 		client:         true,
 		copts:          copts,
 		flateThreshold: opts.CompressionThreshold,
-		br:             getBufioReader(rwc),
-		bw:             getBufioWriter(rwc),
+		br:             getBufioReaderSize(rwc, opts.ReadBufferSize),
+		bw:             getBufioWriterSize(rwc, opts.WriteBufferSize),
+
+		closeHandshakeTimeout: opts.CloseHandshakeTimeout,
+		compressionFallback:   opts.CompressionFallback,
+		compressionDict:       opts.CompressionDictionary,
+		writeQueueSize:        opts.WriteQueueSize,
+		maxFragments:          opts.MaxFragments,
+		maxWireFrameSize:      opts.MaxWireFrameSize,
+		onWriteProgress:       opts.OnWriteProgress,
+		onReadProgress:        opts.OnReadProgress,
+		onMessageWritten:      opts.OnMessageWritten,
+		onError:               opts.OnError,
+		disableMasking:        opts.DisableMasking,
+	}), resp, nil
+}
+
+// DialOnConn is like Dial but performs the WebSocket handshake over nc
+// instead of dialing a new connection, e.g. for a unix socket or a custom
+// transport. The returned *Conn reads from and writes to nc directly.
+//
+// The scheme of u is only used to validate it, nc must already be secured
+// with TLS if required. The HTTPClient and Proxy options are ignored.
+//
+// If ctx expires before the handshake completes, nc is closed. On any other
+// error, nc is left open for the caller to close and the returned response,
+// if non nil, reads its body from nc.
+func DialOnConn(ctx context.Context, u string, nc net.Conn, opts *DialOptions) (_ *Conn, _ *http.Response, err error) {
+	defer errd.Wrap(&err, "failed to WebSocket dial on connection")
+
+	if opts == nil {
+		opts = &DialOptions{}
+	}
+
+	opts = &*opts
+	if opts.HTTPHeader == nil {
+		opts.HTTPHeader = http.Header{}
+	}
+
+	secWebSocketKey, err := dialSecWebSocketKey(opts, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var copts *compressionOptions
+	if opts.CompressionMode != CompressionDisabled {
+		copts = opts.CompressionMode.opts()
+	}
+
+	req, err := newHandshakeRequest(ctx, u, opts, copts, secWebSocketKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	br := getBufioReaderSize(nc, opts.ReadBufferSize)
+
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		err := req.Write(nc)
+		if err != nil {
+			resc <- result{err: fmt.Errorf("failed to write handshake request: %w", err)}
+			return
+		}
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			err = fmt.Errorf("failed to read handshake response: %w", err)
+		}
+		resc <- result{resp, err}
+	}()
+
+	var resp *http.Response
+	select {
+	case <-ctx.Done():
+		nc.Close()
+		<-resc
+		return nil, nil, ctx.Err()
+	case res := <-resc:
+		if res.err != nil {
+			return nil, nil, res.err
+		}
+		resp = res.resp
+	}
+
+	copts, err = verifyServerResponse(opts, copts, secWebSocketKey, resp)
+	if err != nil {
+		return nil, resp, err
+	}
+
+	return newConn(connConfig{
+		subprotocol:    resp.Header.Get("Sec-WebSocket-Protocol"),
+		extensions:     resp.Header.Get("Sec-WebSocket-Extensions"),
+		rwc:            nc,
+		netConn:        nc,
+		client:         true,
+		copts:          copts,
+		flateThreshold: opts.CompressionThreshold,
+		br:             br,
+		bw:             getBufioWriterSize(nc, opts.WriteBufferSize),
+
+		closeHandshakeTimeout: opts.CloseHandshakeTimeout,
+		compressionFallback:   opts.CompressionFallback,
+		compressionDict:       opts.CompressionDictionary,
+		writeQueueSize:        opts.WriteQueueSize,
+		maxFragments:          opts.MaxFragments,
+		maxWireFrameSize:      opts.MaxWireFrameSize,
+		onWriteProgress:       opts.OnWriteProgress,
+		onReadProgress:        opts.OnReadProgress,
+		onMessageWritten:      opts.OnMessageWritten,
+		onError:               opts.OnError,
+		disableMasking:        opts.DisableMasking,
 	}), resp, nil
 }
 
@@ -137,6 +399,24 @@ func handshakeRequest(ctx context.Context, urls string, opts *DialOptions, copts
 		return nil, errors.New("use context for cancellation instead of http.Client.Timeout; see https://github.com/nhooyr/websocket/issues/67")
 	}
 
+	req, err := newHandshakeRequest(ctx, urls, opts, copts, secWebSocketKey)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := proxyClient(opts, req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send handshake request: %w", err)
+	}
+	return resp, nil
+}
+
+func newHandshakeRequest(ctx context.Context, urls string, opts *DialOptions, copts *compressionOptions, secWebSocketKey string) (*http.Request, error) {
 	u, err := url.Parse(urls)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse url: %w", err)
@@ -154,6 +434,9 @@ func handshakeRequest(ctx context.Context, urls string, opts *DialOptions, copts
 
 	req, _ := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
 	req.Header = opts.HTTPHeader.Clone()
+	if opts.Host != "" {
+		req.Host = opts.Host
+	}
 	req.Header.Set("Connection", "Upgrade")
 	req.Header.Set("Upgrade", "websocket")
 	req.Header.Set("Sec-WebSocket-Version", "13")
@@ -164,12 +447,25 @@ func handshakeRequest(ctx context.Context, urls string, opts *DialOptions, copts
 	if copts != nil {
 		copts.setHeader(req.Header)
 	}
+	return req, nil
+}
 
-	resp, err := opts.HTTPClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to send handshake request: %w", err)
+// dialSecWebSocketKey returns the SecWebSocketKey option if set or
+// otherwise generates a random key from rr.
+func dialSecWebSocketKey(opts *DialOptions, rr io.Reader) (string, error) {
+	if opts.SecWebSocketKey == "" {
+		key, err := secWebSocketKey(rr)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate Sec-WebSocket-Key: %w", err)
+		}
+		return key, nil
 	}
-	return resp, nil
+
+	b, err := base64.StdEncoding.DecodeString(opts.SecWebSocketKey)
+	if err != nil || len(b) != 16 {
+		return "", fmt.Errorf("invalid SecWebSocketKey option %q: must be 16 base64 encoded bytes", opts.SecWebSocketKey)
+	}
+	return opts.SecWebSocketKey, nil
 }
 
 func secWebSocketKey(rr io.Reader) (string, error) {
@@ -212,6 +508,23 @@ func verifyServerResponse(opts *DialOptions, copts *compressionOptions, secWebSo
 	return verifyServerExtensions(copts, resp.Header)
 }
 
+// SubprotocolMismatchError is returned by Dial when the server selects a
+// subprotocol that was not one of the Subprotocols requested, which RFC 6455
+// forbids.
+//
+// A server selecting no subprotocol is allowed and not an error. Check
+// Subprotocol on the returned connection for the empty string to handle it.
+//
+// Use Go 1.13's errors.As to check for this error.
+type SubprotocolMismatchError struct {
+	Requested []string
+	Returned  string
+}
+
+func (e SubprotocolMismatchError) Error() string {
+	return fmt.Sprintf("WebSocket protocol violation: unexpected Sec-WebSocket-Protocol from server: %q not in %q", e.Returned, e.Requested)
+}
+
 func verifySubprotocol(subprotos []string, resp *http.Response) error {
 	proto := resp.Header.Get("Sec-WebSocket-Protocol")
 	if proto == "" {
@@ -224,7 +537,10 @@ func verifySubprotocol(subprotos []string, resp *http.Response) error {
 		}
 	}
 
-	return fmt.Errorf("WebSocket protocol violation: unexpected Sec-WebSocket-Protocol from server: %q", proto)
+	return SubprotocolMismatchError{
+		Requested: subprotos,
+		Returned:  proto,
+	}
 }
 
 func verifyServerExtensions(copts *compressionOptions, h http.Header) (*compressionOptions, error) {
@@ -258,6 +574,18 @@ func verifyServerExtensions(copts *compressionOptions, h http.Header) (*compress
 
 var bufioReaderPool sync.Pool
 
+// defaultBufioSize is the size of the pooled bufio readers and writers.
+const defaultBufioSize = 4096
+
+// getBufioReaderSize returns a pooled bufio.Reader unless a non default
+// size is requested in which case a new one is allocated.
+func getBufioReaderSize(r io.Reader, size int) *bufio.Reader {
+	if size <= 0 || size == defaultBufioSize {
+		return getBufioReader(r)
+	}
+	return bufio.NewReaderSize(r, size)
+}
+
 func getBufioReader(r io.Reader) *bufio.Reader {
 	br, ok := bufioReaderPool.Get().(*bufio.Reader)
 	if !ok {
@@ -268,11 +596,22 @@ func getBufioReader(r io.Reader) *bufio.Reader {
 }
 
 func putBufioReader(br *bufio.Reader) {
+	if br.Size() != defaultBufioSize {
+		return
+	}
 	bufioReaderPool.Put(br)
 }
 
 var bufioWriterPool sync.Pool
 
+// getBufioWriterSize is like getBufioReaderSize but for writers.
+func getBufioWriterSize(w io.Writer, size int) *bufio.Writer {
+	if size <= 0 || size == defaultBufioSize {
+		return getBufioWriter(w)
+	}
+	return bufio.NewWriterSize(w, size)
+}
+
 func getBufioWriter(w io.Writer) *bufio.Writer {
 	bw, ok := bufioWriterPool.Get().(*bufio.Writer)
 	if !ok {
@@ -283,5 +622,8 @@ func getBufioWriter(w io.Writer) *bufio.Writer {
 }
 
 func putBufioWriter(bw *bufio.Writer) {
+	if bw.Size() != defaultBufioSize {
+		return
+	}
 	bufioWriterPool.Put(bw)
 }
@@ -3,12 +3,17 @@
 package websocket
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"crypto/rand"
+	"errors"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
@@ -49,6 +54,13 @@ func TestBadDials(t *testing.T) {
 				name: "badTLS",
 				url:  "wss://totallyfake.nhooyr.io",
 			},
+			{
+				name: "badSecWebSocketKey",
+				url:  "ws://nhooyr.io",
+				opts: &DialOptions{
+					SecWebSocketKey: "dGhlIHNhbXBsZQ==",
+				},
+			},
 			{
 				name: "badReader",
 				rand: func(p []byte) (int, error) {
@@ -117,6 +129,339 @@ func TestBadDials(t *testing.T) {
 	})
 }
 
+func TestDialProxy(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name      string
+		newServer func(http.Handler) *httptest.Server
+	}{
+		{
+			name:      "ws",
+			newServer: httptest.NewServer,
+		},
+		{
+			name:      "wss",
+			newServer: httptest.NewTLSServer,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			s := tc.newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				c, err := Accept(w, r, nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer c.Close(StatusInternalError, "")
+
+				err = c.Write(r.Context(), MessageText, []byte("hello"))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				c.Close(StatusNormalClosure, "")
+			}))
+			defer s.Close()
+
+			proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != "CONNECT" {
+					t.Errorf("expected CONNECT request: %v %v", r.Method, r.URL)
+					http.Error(w, "expected CONNECT", http.StatusMethodNotAllowed)
+					return
+				}
+				if r.Header.Get("Upgrade") != "" {
+					t.Errorf("upgrade header leaked to proxy: %v", r.Header)
+				}
+				if r.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+					http.Error(w, "bad proxy auth", http.StatusProxyAuthRequired)
+					return
+				}
+
+				target, err := net.Dial("tcp", r.Host)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadGateway)
+					return
+				}
+				defer target.Close()
+
+				nc, brw, err := w.(http.Hijacker).Hijack()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer nc.Close()
+
+				_, err = io.WriteString(nc, "HTTP/1.1 200 Connection established\r\n\r\n")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				go io.Copy(target, brw)
+				io.Copy(nc, target)
+			}))
+			defer proxy.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+			defer cancel()
+
+			proxyURL, err := url.Parse(proxy.URL)
+			assert.Success(t, err)
+			proxyURL.User = url.UserPassword("user", "pass")
+
+			c, _, err := Dial(ctx, s.URL, &DialOptions{
+				HTTPClient: s.Client(),
+				Proxy:      http.ProxyURL(proxyURL),
+			})
+			assert.Success(t, err)
+			defer c.Close(StatusInternalError, "")
+
+			_, b, err := c.Read(ctx)
+			assert.Success(t, err)
+			assert.Equal(t, "read msg", "hello", string(b))
+
+			_, _, err = c.Read(ctx)
+			assert.Equal(t, "close status", StatusNormalClosure, CloseStatus(err))
+		})
+	}
+
+	t.Run("badAuth", func(t *testing.T) {
+		t.Parallel()
+
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "bad proxy auth", http.StatusProxyAuthRequired)
+		}))
+		defer proxy.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+
+		proxyURL, err := url.Parse(proxy.URL)
+		assert.Success(t, err)
+
+		_, _, err = Dial(ctx, "ws://example.com", &DialOptions{
+			Proxy: http.ProxyURL(proxyURL),
+		})
+		assert.Contains(t, err, "proxy CONNECT failed: 407")
+	})
+}
+
+func TestDialOnConn(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Accept(w, r, &AcceptOptions{
+			Subprotocols: []string{"echo"},
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close(StatusInternalError, "")
+
+		// Written right after the handshake response so it is likely
+		// buffered along with it.
+		err = c.Write(r.Context(), MessageText, []byte("hello"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		c.Close(StatusNormalClosure, "")
+	}))
+	defer s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	nc, err := net.Dial("tcp", s.Listener.Addr().String())
+	assert.Success(t, err)
+	defer nc.Close()
+
+	c, resp, err := DialOnConn(ctx, s.URL, nc, &DialOptions{
+		Subprotocols: []string{"echo"},
+	})
+	assert.Success(t, err)
+	defer c.Close(StatusInternalError, "")
+	assert.Equal(t, "status code", http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "subprotocol", "echo", c.Subprotocol())
+	assert.Equal(t, "net conn", nc, c.NetConn())
+
+	_, b, err := c.Read(ctx)
+	assert.Success(t, err)
+	assert.Equal(t, "read msg", "hello", string(b))
+
+	_, _, err = c.Read(ctx)
+	assert.Equal(t, "close status", StatusNormalClosure, CloseStatus(err))
+}
+
+func TestDialHandshakeRequest(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	reqc := make(chan string, 1)
+	go func() {
+		defer c2.Close()
+
+		var b []byte
+		br := bufio.NewReader(c2)
+		for !bytes.HasSuffix(b, []byte("\r\n\r\n")) {
+			line, err := br.ReadBytes('\n')
+			if err != nil {
+				t.Error(err)
+				break
+			}
+			b = append(b, line...)
+		}
+		reqc <- string(b)
+	}()
+
+	h := http.Header{}
+	h.Add("Authorization", "Bearer token")
+	h.Add("X-Request-Id", "a")
+	h.Add("X-Request-Id", "b")
+	_, _, err := DialOnConn(ctx, "ws://10.0.0.1/path", c1, &DialOptions{
+		HTTPHeader: h,
+		Host:       "example.com",
+	})
+	assert.Error(t, err)
+
+	req := <-reqc
+	for _, line := range []string{
+		"GET /path HTTP/1.1\r\n",
+		"Host: example.com\r\n",
+		"Authorization: Bearer token\r\n",
+		"X-Request-Id: a\r\n",
+		"X-Request-Id: b\r\n",
+		"Upgrade: websocket\r\n",
+	} {
+		assert.Contains(t, req, line)
+	}
+}
+
+func TestDialSecWebSocketKey(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	// The example handshake from RFC 6455 section 1.3.
+	const key = "dGhlIHNhbXBsZSBub25jZQ=="
+	rt := func(r *http.Request) (*http.Response, error) {
+		assert.Equal(t, "Sec-WebSocket-Key", key, r.Header.Get("Sec-WebSocket-Key"))
+
+		h := http.Header{}
+		h.Set("Connection", "Upgrade")
+		h.Set("Upgrade", "websocket")
+		h.Set("Sec-WebSocket-Accept", "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=")
+		return &http.Response{
+			StatusCode: http.StatusSwitchingProtocols,
+			Header:     h,
+			Body:       c1,
+		}, nil
+	}
+
+	c, _, err := Dial(ctx, "ws://example.com", &DialOptions{
+		HTTPClient:      mockHTTPClient(rt),
+		SecWebSocketKey: key,
+		CompressionMode: CompressionDisabled,
+	})
+	assert.Success(t, err)
+
+	c2.Close()
+	c.Close(StatusNormalClosure, "")
+}
+
+func TestDialSubprotocol(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name     string
+		returned string
+		mismatch bool
+	}{
+		{
+			name: "none",
+		},
+		{
+			name:     "valid",
+			returned: "echo",
+		},
+		{
+			name:     "unoffered",
+			returned: "chat",
+			mismatch: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			defer c2.Close()
+
+			rt := func(r *http.Request) (*http.Response, error) {
+				h := http.Header{}
+				h.Set("Connection", "Upgrade")
+				h.Set("Upgrade", "websocket")
+				h.Set("Sec-WebSocket-Accept", secWebSocketAccept(r.Header.Get("Sec-WebSocket-Key")))
+				if tc.returned != "" {
+					h.Set("Sec-WebSocket-Protocol", tc.returned)
+				}
+				return &http.Response{
+					StatusCode: http.StatusSwitchingProtocols,
+					Header:     h,
+					Body:       c1,
+				}, nil
+			}
+
+			if tc.mismatch {
+				// Dial reads the start of the body on errors.
+				c2.Close()
+			}
+			c, _, err := Dial(ctx, "ws://example.com", &DialOptions{
+				HTTPClient:      mockHTTPClient(rt),
+				Subprotocols:    []string{"echo", "echo2"},
+				CompressionMode: CompressionDisabled,
+			})
+			if tc.mismatch {
+				var e SubprotocolMismatchError
+				if !errors.As(err, &e) {
+					t.Fatalf("expected SubprotocolMismatchError but got %v", err)
+				}
+				assert.Equal(t, "requested", []string{"echo", "echo2"}, e.Requested)
+				assert.Equal(t, "returned", tc.returned, e.Returned)
+				return
+			}
+			assert.Success(t, err)
+			assert.Equal(t, "subprotocol", tc.returned, c.Subprotocol())
+
+			c2.Close()
+			c.Close(StatusNormalClosure, "")
+		})
+	}
+}
+
 func Test_verifyServerHandshake(t *testing.T) {
 	t.Parallel()
 
@@ -2,7 +2,9 @@ package websocket
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"math"
@@ -100,6 +102,85 @@ func readFrameHeader(r *bufio.Reader, readBuf []byte) (h header, err error) {
 	return h, nil
 }
 
+// FrameHeader is the exported form of a WebSocket frame header as returned
+// by ParseFrame and written by Conn.WriteRawFrame.
+// See https://tools.ietf.org/html/rfc6455#section-5.2.
+type FrameHeader struct {
+	Fin  bool
+	RSV1 bool
+	RSV2 bool
+	RSV3 bool
+	// Opcode is the raw opcode, e.g. 1 for a text frame or 9 for a ping.
+	Opcode int
+
+	PayloadLength int64
+
+	Masked  bool
+	MaskKey uint32
+}
+
+func (h header) export() FrameHeader {
+	return FrameHeader{
+		Fin:           h.fin,
+		RSV1:          h.rsv1,
+		RSV2:          h.rsv2,
+		RSV3:          h.rsv3,
+		Opcode:        int(h.opcode),
+		PayloadLength: h.payloadLength,
+		Masked:        h.masked,
+		MaskKey:       h.maskKey,
+	}
+}
+
+// ParseFrame parses the first frame in b with the same parser used to read
+// frames from the connection. It is meant for fuzzing and testing code that
+// handles raw frames.
+//
+// The returned payload is unmasked. If the frame is masked, the payload is
+// a copy, otherwise it aliases b. rest is the remainder of b after the frame.
+//
+// An error wrapping io.ErrUnexpectedEOF is returned if b does not contain an
+// entire frame. Frames with reserved opcodes and invalid control frames are
+// rejected like they are on the connection. The RSV bits are not checked as
+// they depend on the negotiated extensions.
+func ParseFrame(b []byte) (_ FrameHeader, payload, rest []byte, err error) {
+	defer errd.Wrap(&err, "failed to parse frame")
+
+	br := bytes.NewReader(b)
+	r := bufio.NewReader(br)
+	h, err := readFrameHeader(r, make([]byte, 8))
+	if errors.Is(err, io.EOF) {
+		err = fmt.Errorf("truncated frame header: %w", io.ErrUnexpectedEOF)
+	}
+	if err != nil {
+		return FrameHeader{}, nil, nil, err
+	}
+	b = b[len(b)-br.Len()-r.Buffered():]
+
+	switch h.opcode {
+	case opContinuation, opText, opBinary:
+	case opClose, opPing, opPong:
+		if h.payloadLength > maxControlPayload {
+			return FrameHeader{}, nil, nil, fmt.Errorf("received control frame payload with invalid length: %d", h.payloadLength)
+		}
+		if !h.fin {
+			return FrameHeader{}, nil, nil, errors.New("received fragmented control frame")
+		}
+	default:
+		return FrameHeader{}, nil, nil, fmt.Errorf("received unknown opcode %v", h.opcode)
+	}
+
+	if h.payloadLength > int64(len(b)) {
+		return FrameHeader{}, nil, nil, fmt.Errorf("payload length %v exceeds remaining %v bytes: %w", h.payloadLength, len(b), io.ErrUnexpectedEOF)
+	}
+	payload, rest = b[:h.payloadLength], b[h.payloadLength:]
+	if h.masked {
+		payload = append([]byte(nil), payload...)
+		mask(h.maskKey, payload)
+	}
+	return h.export(), payload, rest, nil
+}
+
 // maxControlPayload is the maximum length of a control frame payload.
 // See https://tools.ietf.org/html/rfc6455#section-5.5.
 const maxControlPayload = 125
@@ -0,0 +1,87 @@
+// +build go1.18,!js
+
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"math/bits"
+	"testing"
+
+	"nhooyr.io/websocket/internal/test/assert"
+)
+
+func FuzzParseFrame(f *testing.F) {
+	f.Add([]byte{0x81, 0x85, 0xef, 0xbe, 0xad, 0xde, 0x87, 0xdb, 0xc1, 0xb2, 0x80})
+	f.Add([]byte{0x89, 0x00})
+	f.Add([]byte{0x82, 126, 0x01, 0x00})
+	f.Add([]byte{0x82, 127, 0xff, 0, 0, 0, 0, 0, 0, 0})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		h, p, rest, err := ParseFrame(b)
+		if err != nil {
+			return
+		}
+		assert.Equal(t, "payload length", h.PayloadLength, int64(len(p)))
+
+		// Encoding the parsed frame again must give back the same bytes.
+		buf := &bytes.Buffer{}
+		w := bufio.NewWriter(buf)
+		err = writeFrameHeader(header{
+			fin:           h.Fin,
+			rsv1:          h.RSV1,
+			rsv2:          h.RSV2,
+			rsv3:          h.RSV3,
+			opcode:        opcode(h.Opcode),
+			payloadLength: h.PayloadLength,
+			masked:        h.Masked,
+			maskKey:       h.MaskKey,
+		}, w, make([]byte, 8))
+		assert.Success(t, err)
+		p = append([]byte(nil), p...)
+		if h.Masked {
+			mask(h.MaskKey, p)
+		}
+		_, err = w.Write(p)
+		assert.Success(t, err)
+		err = w.Flush()
+		assert.Success(t, err)
+
+		h2, _, rest2, err := ParseFrame(append(buf.Bytes(), rest...))
+		assert.Success(t, err)
+		assert.Equal(t, "header", h, h2)
+		assert.Equal(t, "rest", rest, rest2)
+	})
+}
+
+func FuzzMask(f *testing.F) {
+	f.Add(uint32(0xdeadbeef), uint8(0), uint16(0), []byte("hello"))
+	f.Add(uint32(0x0a0b0cff), uint8(3), uint16(2), []byte{0xa, 0xb, 0xc, 0xf2, 0xc})
+	f.Add(uint32(1), uint8(7), uint16(100), bytes.Repeat([]byte{0xff}, 300))
+
+	f.Fuzz(func(t *testing.T, key32 uint32, off uint8, split uint16, b []byte) {
+		var key [4]byte
+		binary.LittleEndian.PutUint32(key[:], key32)
+
+		// Offset into the buffer so that unaligned slices are covered.
+		buf := make([]byte, int(off%8)+len(b))
+		p := buf[off%8:]
+		copy(p, b)
+
+		exp := make([]byte, len(b))
+		copy(exp, b)
+		pos := basicMask(key, 0, exp)
+
+		// Mask in two chunks to cover rotating the key across calls.
+		n := int(split)
+		if n > len(p) {
+			n = len(p)
+		}
+		gotKey32 := mask(key32, p[:n])
+		gotKey32 = mask(gotKey32, p[n:])
+
+		assert.Equal(t, "masked", exp, p)
+		assert.Equal(t, "key", bits.RotateLeft32(key32, -8*pos), gotKey32)
+	})
+}
@@ -6,6 +6,8 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"io"
 	"math/bits"
 	"math/rand"
 	"strconv"
@@ -107,6 +109,38 @@ func Test_mask(t *testing.T) {
 	assert.Equal(t, "key32", expKey32, gotKey32)
 }
 
+func Test_maskBasic(t *testing.T) {
+	t.Parallel()
+
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	for i := 0; i < 1000; i++ {
+		var key [4]byte
+		r.Read(key[:])
+		key32 := binary.LittleEndian.Uint32(key[:])
+
+		// Offset into the buffer so that unaligned slices are covered.
+		off := r.Intn(8)
+		b := make([]byte, off+r.Intn(1024))
+		r.Read(b)
+		b = b[off:]
+
+		exp := make([]byte, len(b))
+		copy(exp, b)
+		basicMask(key, 0, exp)
+
+		// Mask in two chunks to cover rotating the key across calls.
+		split := 0
+		if len(b) > 0 {
+			split = r.Intn(len(b))
+		}
+		key32 = mask(key32, b[:split])
+		mask(key32, b[split:])
+
+		assert.Equal(t, "masked", exp, b)
+	}
+}
+
 func basicMask(maskKey [4]byte, pos int, b []byte) int {
 	for i := range b {
 		b[i] ^= maskKey[pos&3]
@@ -130,6 +164,7 @@ func Benchmark_mask(b *testing.B) {
 		512,
 		4096,
 		16384,
+		65536,
 	}
 
 	fns := []struct {
@@ -190,3 +225,107 @@ func Benchmark_mask(b *testing.B) {
 		})
 	}
 }
+
+func TestParseFrame(t *testing.T) {
+	t.Parallel()
+
+	encode := func(h header, p []byte) []byte {
+		b := &bytes.Buffer{}
+		w := bufio.NewWriter(b)
+		h.payloadLength = int64(len(p))
+		err := writeFrameHeader(h, w, make([]byte, 8))
+		assert.Success(t, err)
+		p = append([]byte(nil), p...)
+		if h.masked {
+			mask(h.maskKey, p)
+		}
+		_, err = w.Write(p)
+		assert.Success(t, err)
+		err = w.Flush()
+		assert.Success(t, err)
+		return b.Bytes()
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		t.Parallel()
+
+		b := encode(header{fin: true, opcode: opText, masked: true, maskKey: 0xdeadbeef}, []byte("hello"))
+		b = append(b, encode(header{fin: true, opcode: opPing}, []byte("ping"))...)
+
+		h, p, rest, err := ParseFrame(b)
+		assert.Success(t, err)
+		assert.Equal(t, "header", FrameHeader{
+			Fin:           true,
+			Opcode:        1,
+			PayloadLength: 5,
+			Masked:        true,
+			MaskKey:       0xdeadbeef,
+		}, h)
+		assert.Equal(t, "payload", "hello", string(p))
+
+		h, p, rest, err = ParseFrame(rest)
+		assert.Success(t, err)
+		assert.Equal(t, "opcode", 9, h.Opcode)
+		assert.Equal(t, "payload", "ping", string(p))
+		assert.Equal(t, "rest", 0, len(rest))
+	})
+
+	testCases := []struct {
+		name       string
+		b          []byte
+		unexpected bool
+		err        string
+	}{
+		{
+			name:       "empty",
+			b:          nil,
+			unexpected: true,
+		},
+		{
+			name:       "truncatedHeader",
+			b:          encode(header{fin: true, opcode: opBinary, masked: true}, nil)[:3],
+			unexpected: true,
+		},
+		{
+			name:       "truncatedPayload",
+			b:          encode(header{fin: true, opcode: opBinary}, make([]byte, 300))[:100],
+			unexpected: true,
+		},
+		{
+			name: "reservedOpcode",
+			b:    encode(header{fin: true, opcode: 3}, nil),
+			err:  "received unknown opcode",
+		},
+		{
+			name: "fragmentedControl",
+			b:    encode(header{opcode: opPing}, nil),
+			err:  "received fragmented control frame",
+		},
+		{
+			name: "oversizedControl",
+			b:    encode(header{fin: true, opcode: opClose}, make([]byte, 126)),
+			err:  "received control frame payload with invalid length",
+		},
+		{
+			name: "negativeLength",
+			b:    []byte{0x82, 127, 0xff, 0, 0, 0, 0, 0, 0, 0},
+			err:  "received negative payload length",
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, _, _, err := ParseFrame(tc.b)
+			if tc.unexpected {
+				if !errors.Is(err, io.ErrUnexpectedEOF) {
+					t.Fatalf("expected io.ErrUnexpectedEOF but got %v", err)
+				}
+				return
+			}
+			assert.Contains(t, err, tc.err)
+		})
+	}
+}
@@ -128,6 +128,11 @@ func (c WebSocket) Subprotocol() string {
 	return c.v.Get("protocol").String()
 }
 
+// Extensions returns the WebSocket extensions selected by the server.
+func (c WebSocket) Extensions() string {
+	return c.v.Get("extensions").String()
+}
+
 // OnOpen registers a function to be called when the WebSocket is opened.
 func (c WebSocket) OnOpen(fn func(e js.Value)) (remove func()) {
 	return c.addEventListener("open", fn)
@@ -0,0 +1,64 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"nhooyr.io/websocket/internal/bpool"
+	"nhooyr.io/websocket/internal/errd"
+)
+
+// ReadJSON reads a JSON text message from the connection into v.
+// It will reuse buffers in between calls to avoid allocations.
+//
+// If the message cannot be unmarshalled, the connection is closed
+// with StatusInvalidFramePayloadData.
+//
+// See the wsjson package for an equivalent function.
+func (c *Conn) ReadJSON(ctx context.Context, v interface{}) (err error) {
+	defer errd.Wrap(&err, "failed to read JSON message")
+
+	_, r, err := c.Reader(ctx)
+	if err != nil {
+		return err
+	}
+
+	b := bpool.Get()
+	defer bpool.Put(b)
+
+	_, err = b.ReadFrom(r)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(b.Bytes(), v)
+	if err != nil {
+		c.Close(StatusInvalidFramePayloadData, "failed to unmarshal JSON")
+		return fmt.Errorf("failed to unmarshal JSON: %w", err)
+	}
+
+	return nil
+}
+
+// WriteJSON writes v as a JSON text message to the connection.
+// It will reuse buffers in between calls to avoid allocations.
+//
+// See the wsjson package for an equivalent function.
+func (c *Conn) WriteJSON(ctx context.Context, v interface{}) (err error) {
+	defer errd.Wrap(&err, "failed to write JSON message")
+
+	w, err := c.Writer(ctx, MessageText)
+	if err != nil {
+		return err
+	}
+
+	// json.Marshal cannot reuse buffers between calls as it has to return
+	// a copy of the byte slice but Encoder does as it directly writes to w.
+	err = json.NewEncoder(w).Encode(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+
+	return w.Close()
+}
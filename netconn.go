@@ -38,9 +38,57 @@ import (
 // A received StatusNormalClosure or StatusGoingAway close frame will be translated to
 // io.EOF when reading.
 func NetConn(ctx context.Context, c *Conn, msgType MessageType) net.Conn {
+	return NetConnWithOptions(ctx, c, &NetConnOptions{
+		MessageType: msgType,
+	})
+}
+
+// NetConnOptions represents the options available to pass to NetConnWithOptions.
+type NetConnOptions struct {
+	// MessageType is the type of the messages written to the *websocket.Conn
+	// and the type expected of messages read from it.
+	//
+	// Defaults to MessageBinary.
+	MessageType MessageType
+
+	// AcceptAnyType treats read messages of either type as data instead of
+	// closing the connection with StatusUnsupportedData when a message is not
+	// of MessageType. Writes still use MessageType.
+	AcceptAnyType bool
+
+	// KeepAliveInterval enables pinging the peer at the given interval for as
+	// long as the net.Conn is open so that protocols tunneled over it that
+	// expect the connection to stay up are not cut off by idle intermediaries.
+	// Pings are control frames so they never show up in the byte stream.
+	//
+	// If a pong is not received within KeepAliveTimeout, the connection is
+	// closed and reads and writes on the net.Conn fail. KeepAliveTimeout
+	// defaults to KeepAliveInterval. As with Ping, pongs are only received
+	// while the net.Conn is being read from. Close waits for a ping in flight
+	// to complete before closing the connection.
+	//
+	// *websocket.Conn does not ping on its own so there is no other keepalive
+	// to disable but do not also call Ping in a loop on the wrapped Conn for
+	// the same purpose. Pings from the peer are answered either way.
+	KeepAliveInterval time.Duration
+	KeepAliveTimeout  time.Duration
+}
+
+// NetConnWithOptions is like NetConn but allows configuring the net.Conn
+// with opts. A nil opts uses the defaults.
+func NetConnWithOptions(ctx context.Context, c *Conn, opts *NetConnOptions) net.Conn {
+	if opts == nil {
+		opts = &NetConnOptions{}
+	}
+	msgType := opts.MessageType
+	if msgType == 0 {
+		msgType = MessageBinary
+	}
+
 	nc := &netConn{
-		c:       c,
-		msgType: msgType,
+		c:             c,
+		msgType:       msgType,
+		acceptAnyType: opts.AcceptAnyType,
 	}
 
 	var cancel context.CancelFunc
@@ -56,12 +104,53 @@ func NetConn(ctx context.Context, c *Conn, msgType MessageType) net.Conn {
 		<-nc.readTimer.C
 	}
 
+	if opts.KeepAliveInterval > 0 {
+		timeout := opts.KeepAliveTimeout
+		if timeout <= 0 {
+			timeout = opts.KeepAliveInterval
+		}
+		nc.keepAliveStop = make(chan struct{})
+		nc.keepAliveDone = make(chan struct{})
+		go nc.keepAlive(ctx, opts.KeepAliveInterval, timeout)
+	}
+
 	return nc
 }
 
+// keepAlive pings the peer every interval until ctx is cancelled or
+// keepAliveStop is closed. Ping closes the connection if a pong does not
+// arrive within timeout.
+//
+// keepAliveStop is separate from ctx so that stopping on Close never cancels
+// an in flight Ping which would close the connection as if the pong timed out.
+func (c *netConn) keepAlive(ctx context.Context, interval, timeout time.Duration) {
+	defer close(c.keepAliveDone)
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.keepAliveStop:
+			return
+		case <-t.C:
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		err := c.c.Ping(ctx)
+		cancel()
+		if err != nil {
+			return
+		}
+	}
+}
+
 type netConn struct {
-	c       *Conn
-	msgType MessageType
+	c             *Conn
+	msgType       MessageType
+	acceptAnyType bool
 
 	writeTimer   *time.Timer
 	writeContext context.Context
@@ -72,11 +161,21 @@ type netConn struct {
 	readMu sync.Mutex
 	eofed  bool
 	reader io.Reader
+
+	keepAliveStopOnce sync.Once
+	keepAliveStop     chan struct{}
+	keepAliveDone     chan struct{}
 }
 
 var _ net.Conn = &netConn{}
 
 func (c *netConn) Close() error {
+	if c.keepAliveStop != nil {
+		c.keepAliveStopOnce.Do(func() {
+			close(c.keepAliveStop)
+		})
+		<-c.keepAliveDone
+	}
 	return c.c.Close(StatusNormalClosure, "")
 }
 
@@ -106,7 +205,7 @@ func (c *netConn) Read(p []byte) (int, error) {
 			}
 			return 0, err
 		}
-		if typ != c.msgType {
+		if typ != c.msgType && !c.acceptAnyType {
 			err := fmt.Errorf("unexpected frame type read (expected %v): %v", c.msgType, typ)
 			c.c.Close(StatusUnsupportedData, err.Error())
 			return 0, err
@@ -0,0 +1,164 @@
+// +build !js
+
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// proxyClient returns the client to send the handshake request with.
+//
+// If the request is to be proxied through an HTTP or HTTPS proxy, the returned
+// client's transport tunnels every connection through the proxy with CONNECT
+// so that the proxy never sees the upgrade request. Otherwise the transport
+// is left to handle the proxy itself.
+func proxyClient(opts *DialOptions, req *http.Request) (*http.Client, error) {
+	client := opts.HTTPClient
+
+	rt := client.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	t, ok := rt.(*http.Transport)
+	if !ok {
+		return client, nil
+	}
+
+	proxy := opts.Proxy
+	if proxy == nil {
+		proxy = t.Proxy
+	}
+	if proxy == nil {
+		return client, nil
+	}
+
+	proxyURL, err := proxy(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get proxy for request: %w", err)
+	}
+	if proxyURL == nil && (opts.Proxy == nil || t.Proxy == nil) {
+		// Either there is no proxy or the transport would not use one anyway.
+		return client, nil
+	}
+
+	t = t.Clone()
+	t.Proxy = nil
+	// The connections are never reused as they are either hijacked
+	// for the WebSocket or the handshake failed.
+	t.DisableKeepAlives = true
+
+	if proxyURL != nil {
+		switch proxyURL.Scheme {
+		case "http", "https":
+			dial := t.DialContext
+			if dial == nil {
+				dial = (&net.Dialer{}).DialContext
+			}
+			t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialProxyTunnel(ctx, dial, proxyURL, addr)
+			}
+		default:
+			t.Proxy = http.ProxyURL(proxyURL)
+		}
+	}
+
+	client2 := *client
+	client2.Transport = t
+	return &client2, nil
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// dialProxyTunnel connects to addr through the HTTP proxy at proxyURL
+// with a CONNECT request.
+func dialProxyTunnel(ctx context.Context, dial dialFunc, proxyURL *url.URL, addr string) (_ net.Conn, err error) {
+	conn, err := dial(ctx, "tcp", proxyAddr(proxyURL))
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial proxy: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	resc := make(chan result, 1)
+	go func() {
+		conn := conn
+		if proxyURL.Scheme == "https" {
+			tlsConn := tls.Client(conn, &tls.Config{
+				ServerName: proxyURL.Hostname(),
+			})
+			err := tlsConn.Handshake()
+			if err != nil {
+				resc <- result{err: fmt.Errorf("failed to TLS handshake with proxy: %w", err)}
+				return
+			}
+			conn = tlsConn
+		}
+		resc <- result{conn, proxyConnect(conn, proxyURL, addr)}
+	}()
+
+	select {
+	case <-ctx.Done():
+		conn.Close()
+		<-resc
+		return nil, ctx.Err()
+	case res := <-resc:
+		if res.err != nil {
+			return nil, res.err
+		}
+		return res.conn, nil
+	}
+}
+
+func proxyConnect(conn net.Conn, proxyURL *url.URL, addr string) error {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := proxyURL.User; u != nil {
+		password, _ := u.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	err := req.Write(conn)
+	if err != nil {
+		return fmt.Errorf("failed to write CONNECT request to proxy: %w", err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return fmt.Errorf("failed to read CONNECT response from proxy: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy CONNECT failed: %v", resp.Status)
+	}
+	return nil
+}
+
+func proxyAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
@@ -4,6 +4,7 @@ package websocket
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -23,10 +24,19 @@ import (
 // The passed context will also bound the reader.
 // Ensure you read to EOF otherwise the connection will hang.
 //
+// Control frames the peer interleaves between the frames of a fragmented
+// message are handled as they are reached by reads from the io.Reader, so
+// pings are answered mid message. Frames are only read while the io.Reader
+// is being read from however, so a consumer that stalls for long should
+// expect the peer to time out.
+//
 // Call CloseRead if you do not expect any data messages from the peer.
 //
 // Only one Reader may be open at a time.
 func (c *Conn) Reader(ctx context.Context) (MessageType, io.Reader, error) {
+	if c.isReadClosed.Load() == 1 {
+		return 0, nil, errors.New("WebSocket connection read closed")
+	}
 	return c.reader(ctx)
 }
 
@@ -42,6 +52,139 @@ func (c *Conn) Read(ctx context.Context) (MessageType, []byte, error) {
 	return typ, b, err
 }
 
+// ReadInto is like Read but reads the message into buf instead of
+// allocating a new slice for every message. It returns the number
+// of bytes read into buf.
+//
+// If the message does not fit in buf, buf is filled with the start
+// of the message, the rest of it is discarded and a BufferTooSmallError
+// is returned with the size of the message so that buf can be grown
+// for the next read. The connection remains usable.
+func (c *Conn) ReadInto(ctx context.Context, buf []byte) (MessageType, int, error) {
+	typ, r, err := c.Reader(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	n, err := io.ReadFull(r, buf)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return typ, n, nil
+	}
+	if err != nil {
+		return typ, n, err
+	}
+
+	rest, err := io.Copy(ioutil.Discard, r)
+	if err != nil {
+		return typ, n, err
+	}
+	if rest > 0 {
+		return typ, n, BufferTooSmallError{
+			Size: int64(n) + rest,
+		}
+	}
+	return typ, n, nil
+}
+
+// PeekMessage is like Reader but first reads up to n bytes of the message, across
+// frame boundaries if need be, and returns them along with a reader for the rest
+// of the message. This allows routing a message on its first bytes without
+// buffering all of it.
+//
+// If the message is shorter than n bytes, the entire message is returned and the
+// reader is at EOF. As with Reader, the rest of the message must be read to EOF
+// before the next message can be read.
+//
+// n must not be negative. The buffer returned only grows as bytes are read so
+// a large n does not allocate more than the message holds.
+func (c *Conn) PeekMessage(ctx context.Context, n int) (MessageType, []byte, io.Reader, error) {
+	if n < 0 {
+		return 0, nil, nil, fmt.Errorf("failed to peek message: negative length %v", n)
+	}
+
+	typ, r, err := c.Reader(ctx)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	var b bytes.Buffer
+	_, err = b.ReadFrom(io.LimitReader(r, int64(n)))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return typ, b.Bytes(), r, nil
+}
+
+// SkipMessage reads and discards the rest of the current message, e.g. one
+// returned by PeekMessage, so that the next message can be read. If the current
+// message has already been read to completion, the next message is skipped
+// instead.
+//
+// The read limit still applies and control frames received in the meantime are
+// handled as usual.
+func (c *Conn) SkipMessage(ctx context.Context) (err error) {
+	defer errd.Wrap(&err, "failed to skip message")
+
+	if c.isReadClosed.Load() == 1 {
+		return errors.New("WebSocket connection read closed")
+	}
+
+	// The message state is only stable while readMu is held.
+	err = c.readMu.lock(ctx)
+	if err != nil {
+		c.close(err)
+		return err
+	}
+	if c.msgReader.inProgress() {
+		c.msgReader.ctx = ctx
+	} else {
+		_, _, err = c.readerLocked(ctx)
+		if err != nil {
+			c.readMu.unlock()
+			return fmt.Errorf("failed to get reader: %w", err)
+		}
+	}
+	c.readMu.unlock()
+
+	_, err = io.Copy(ioutil.Discard, c.msgReader)
+	return err
+}
+
+// NextMessageType waits for the next data message to start and returns its type
+// without reading any of it. The following call to Reader or Read returns that
+// message. Control frames received in the meantime are handled as usual.
+//
+// Calling NextMessageType again before reading the message returns the same type.
+func (c *Conn) NextMessageType(ctx context.Context) (_ MessageType, err error) {
+	defer errd.Wrap(&err, "failed to get next message type")
+
+	if c.isReadClosed.Load() == 1 {
+		return 0, errors.New("WebSocket connection read closed")
+	}
+
+	err = c.readMu.lock(ctx)
+	if err != nil {
+		c.close(err)
+		return 0, err
+	}
+	defer c.readMu.unlock()
+
+	if c.nextHeader == nil {
+		if !c.msgReader.fin {
+			err = errors.New("previous message not read to completion")
+			c.close(fmt.Errorf("failed to get next message type: %w", err))
+			return 0, err
+		}
+
+		h, err := c.readDataHeader(ctx)
+		if err != nil {
+			return 0, err
+		}
+		c.nextHeader = &h
+	}
+	return MessageType(c.nextHeader.opcode), nil
+}
+
 // CloseRead starts a goroutine to read from the connection until it is closed
 // or a data message is received.
 //
@@ -54,10 +197,12 @@ func (c *Conn) Read(ctx context.Context) (MessageType, []byte, error) {
 // Since it actively reads from the connection, it will ensure that ping, pong and close
 // frames are responded to. This means c.Ping and c.Close will still work as expected.
 func (c *Conn) CloseRead(ctx context.Context) context.Context {
+	c.isReadClosed.Store(1)
+
 	ctx, cancel := context.WithCancel(ctx)
 	go func() {
 		defer cancel()
-		c.Reader(ctx)
+		c.reader(ctx)
 		c.Close(StatusPolicyViolation, "unexpected data message")
 	}()
 	return ctx
@@ -68,11 +213,32 @@ func (c *Conn) CloseRead(ctx context.Context) context.Context {
 //
 // By default, the connection has a message read limit of 32768 bytes.
 //
-// When the limit is hit, the connection will be closed with StatusMessageTooBig.
+// For compressed messages the limit applies to the decompressed bytes and is
+// enforced as the message is inflated, so inflation stops as soon as the limit
+// is exceeded no matter how far the message would have expanded.
+//
+// When the limit is hit, the connection will be closed with StatusMessageTooBig
+// and the error returned wraps ErrReadLimitExceeded. The bytes read before the
+// limit was hit are still returned, Read returns them alongside the error and
+// the Reader returns them before the error, so that the start of an oversized
+// message can be inspected.
+//
+// Pass -1 to disable the limit.
+//
+// SetReadLimit is safe to call concurrently with a read. The new limit
+// applies from the next message onwards, a message already being read
+// is still bounded by the limit that was in effect when it began.
 func (c *Conn) SetReadLimit(n int64) {
-	// We add read one more byte than the limit in case
-	// there is a fin frame that needs to be read.
-	c.msgReader.limitReader.limit.Store(n + 1)
+	if n < 0 {
+		n = -1
+	}
+	c.msgReader.limitReader.limit.Store(n)
+}
+
+// ReadLimit returns the current read limit set with SetReadLimit.
+// -1 means the limit is disabled.
+func (c *Conn) ReadLimit() int64 {
+	return c.msgReader.limitReader.limit.Load()
 }
 
 const defaultReadLimit = 32768
@@ -84,13 +250,15 @@ func newMsgReader(c *Conn) *msgReader {
 	}
 	mr.readFunc = mr.read
 
-	mr.limitReader = newLimitReader(c, mr.readFunc, defaultReadLimit+1)
+	mr.limitReader = newLimitReader(c, mr.readFunc, defaultReadLimit)
 	return mr
 }
 
 func (mr *msgReader) resetFlate() {
-	if mr.flateContextTakeover() {
-		mr.dict.init(32768)
+	// Without context takeover, the dictionary is only ever the seed which
+	// is never written to.
+	if mr.flateContextTakeover() || len(mr.c.compressionDict) > 0 {
+		mr.dict.init(32768, mr.c.compressionDict)
 	}
 	if mr.flateBufio == nil {
 		mr.flateBufio = getBufioReader(mr.readFunc)
@@ -129,16 +297,28 @@ func (mr *msgReader) flateContextTakeover() bool {
 	return !mr.c.copts.clientNoContextTakeover
 }
 
-func (c *Conn) readRSV1Illegal(h header) bool {
-	// If compression is disabled, rsv1 is illegal.
-	if !c.flate() {
-		return true
+// checkRSV returns an error describing the first reserved bit in h that
+// is set without a negotiated extension defining it.
+// See https://tools.ietf.org/html/rfc6455#section-5.2
+func (c *Conn) checkRSV(h header) error {
+	if h.rsv1 {
+		// If compression is disabled, rsv1 is illegal.
+		if !c.flate() {
+			return errors.New("received frame with RSV1 bit set but permessage-deflate was not negotiated")
+		}
+		// rsv1 is only allowed on data frames beginning messages
+		// except with x-webkit-deflate-frame where every frame may set it.
+		if h.opcode != opText && h.opcode != opBinary && (h.opcode != opContinuation || !c.deflateFrame()) {
+			return fmt.Errorf("received %v frame with RSV1 bit set", h.opcode)
+		}
 	}
-	// rsv1 is only allowed on data frames beginning messages.
-	if h.opcode != opText && h.opcode != opBinary {
-		return true
+	if h.rsv2 {
+		return errors.New("received frame with unexpected RSV2 bit set")
 	}
-	return false
+	if h.rsv3 {
+		return errors.New("received frame with unexpected RSV3 bit set")
+	}
+	return nil
 }
 
 func (c *Conn) readLoop(ctx context.Context) (header, error) {
@@ -148,14 +328,16 @@ func (c *Conn) readLoop(ctx context.Context) (header, error) {
 			return header{}, err
 		}
 
-		if h.rsv1 && c.readRSV1Illegal(h) || h.rsv2 || h.rsv3 {
-			err := fmt.Errorf("received header with unexpected rsv bits set: %v:%v:%v", h.rsv1, h.rsv2, h.rsv3)
+		err = c.checkRSV(h)
+		if err != nil {
 			c.writeError(StatusProtocolError, err)
 			return header{}, err
 		}
 
 		if !c.client && !h.masked {
-			return header{}, errors.New("received unmasked frame from client")
+			err := errors.New("received unmasked frame from client")
+			c.writeError(StatusProtocolError, err)
+			return header{}, err
 		}
 
 		switch h.opcode {
@@ -169,6 +351,11 @@ func (c *Conn) readLoop(ctx context.Context) (header, error) {
 				return header{}, fmt.Errorf("failed to handle control frame %v: %w", h.opcode, err)
 			}
 		case opContinuation, opText, opBinary:
+			if c.maxWireFrameSize > 0 && h.payloadLength > c.maxWireFrameSize {
+				err := fmt.Errorf("received frame of %v bytes exceeding max wire frame size of %v bytes", h.payloadLength, c.maxWireFrameSize)
+				c.writeError(StatusMessageTooBig, err)
+				return header{}, err
+			}
 			return h, nil
 		default:
 			err := fmt.Errorf("received unknown opcode %v", h.opcode)
@@ -193,11 +380,16 @@ func (c *Conn) readFrameHeader(ctx context.Context) (header, error) {
 		case <-ctx.Done():
 			return header{}, ctx.Err()
 		default:
+			err = abnormalClosureError(fmt.Errorf("failed to read frame header: %w", err))
 			c.close(err)
 			return header{}, err
 		}
 	}
 
+	if c.idleTimer != nil {
+		c.idleTimer.Reset(c.idleTimeout)
+	}
+
 	select {
 	case <-c.closed:
 		return header{}, c.closeErr
@@ -222,7 +414,7 @@ func (c *Conn) readFramePayload(ctx context.Context, p []byte) (int, error) {
 		case <-ctx.Done():
 			return n, ctx.Err()
 		default:
-			err = fmt.Errorf("failed to read frame payload: %w", err)
+			err = abnormalClosureError(fmt.Errorf("failed to read frame payload: %w", err))
 			c.close(err)
 			return n, err
 		}
@@ -237,6 +429,41 @@ func (c *Conn) readFramePayload(ctx context.Context, p []byte) (int, error) {
 	return n, err
 }
 
+// abnormalClosureError wraps a transport error to indicate that the
+// connection was lost without a close frame so that CloseStatus returns
+// StatusAbnormalClosure.
+func abnormalClosureError(err error) error {
+	return abnormalClosure{err: err}
+}
+
+// abnormalClosure keeps the transport error in the chain for errors.Is and
+// errors.As while also matching CloseError.
+type abnormalClosure struct {
+	err error
+}
+
+func (e abnormalClosure) closeError() CloseError {
+	return CloseError{
+		Code: StatusAbnormalClosure,
+	}
+}
+
+func (e abnormalClosure) Error() string {
+	return fmt.Sprintf("%v: %v", e.err, e.closeError())
+}
+
+func (e abnormalClosure) Unwrap() error {
+	return e.err
+}
+
+func (e abnormalClosure) As(target interface{}) bool {
+	ce, ok := target.(*CloseError)
+	if ok {
+		*ce = e.closeError()
+	}
+	return ok
+}
+
 func (c *Conn) handleControl(ctx context.Context, h header) (err error) {
 	if h.payloadLength < 0 || h.payloadLength > maxControlPayload {
 		err := fmt.Errorf("received control frame payload with invalid length: %d", h.payloadLength)
@@ -250,7 +477,7 @@ func (c *Conn) handleControl(ctx context.Context, h header) (err error) {
 		return err
 	}
 
-	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	ctx, cancel := c.withCloseHandshakeTimeout(ctx)
 	defer cancel()
 
 	b := c.readControlBuf[:h.payloadLength]
@@ -265,13 +492,47 @@ func (c *Conn) handleControl(ctx context.Context, h header) (err error) {
 
 	switch h.opcode {
 	case opPing:
+		if c.pingLimiter != nil && !c.pingLimiter.allow(time.Now()) {
+			if c.closePingFlood {
+				err := errors.New("exceeded maximum pings per second")
+				c.writeError(StatusPolicyViolation, err)
+				return err
+			}
+			return nil
+		}
+
+		c.activePingsMu.Lock()
+		pingHandler := c.pingHandler
+		c.activePingsMu.Unlock()
+		if pingHandler != nil {
+			err := pingHandler(ctx, b)
+			if errors.Is(err, ErrSkipPong) {
+				return nil
+			}
+			if err != nil {
+				err = fmt.Errorf("ping handler failed: %w", err)
+				c.writeError(StatusPolicyViolation, err)
+				return err
+			}
+		}
 		return c.writeControl(ctx, opPong, b)
 	case opPong:
 		c.activePingsMu.Lock()
-		pong, ok := c.activePings[string(b)]
+		ping, ok := c.activePings[string(b)]
+		if ok {
+			// Prevents a duplicate pong from closing the channel twice.
+			delete(c.activePings, string(b))
+		}
+		pongHandler := c.pongHandler
 		c.activePingsMu.Unlock()
+		var rtt time.Duration
 		if ok {
-			close(pong)
+			rtt = time.Since(ping.sent)
+			c.lastRTT.Store(int64(rtt))
+			close(ping.pong)
+		}
+		if pongHandler != nil {
+			pongHandler(b, rtt)
 		}
 		return nil
 	}
@@ -294,35 +555,89 @@ func (c *Conn) handleControl(ctx context.Context, h header) (err error) {
 	return err
 }
 
+// pingLimiter is a token bucket limiting the rate pings are answered.
+// It is only used by the goroutine reading frames so it is not safe
+// for concurrent use.
+type pingLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newPingLimiter(perSecond int) *pingLimiter {
+	return &pingLimiter{
+		rate:   float64(perSecond),
+		tokens: float64(perSecond),
+		last:   time.Now(),
+	}
+}
+
+// allow reports whether a ping received at now may be answered.
+func (l *pingLimiter) allow(now time.Time) bool {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
 func (c *Conn) reader(ctx context.Context) (_ MessageType, _ io.Reader, err error) {
 	defer errd.Wrap(&err, "failed to get reader")
 
 	err = c.readMu.lock(ctx)
 	if err != nil {
+		c.close(err)
 		return 0, nil, err
 	}
 	defer c.readMu.unlock()
 
-	if !c.msgReader.fin {
-		err = errors.New("previous message not read to completion")
-		c.close(fmt.Errorf("failed to get reader: %w", err))
-		return 0, nil, err
+	return c.readerLocked(ctx)
+}
+
+// readerLocked starts reading the next message. readMu must be held.
+func (c *Conn) readerLocked(ctx context.Context) (MessageType, io.Reader, error) {
+	var h header
+	var err error
+	if c.nextHeader != nil {
+		h = *c.nextHeader
+		c.nextHeader = nil
+	} else {
+		if !c.msgReader.fin {
+			err = errors.New("previous message not read to completion")
+			c.close(fmt.Errorf("failed to get reader: %w", err))
+			return 0, nil, err
+		}
+
+		h, err = c.readDataHeader(ctx)
+		if err != nil {
+			return 0, nil, err
+		}
 	}
 
+	c.msgReader.reset(ctx, h)
+
+	return MessageType(h.opcode), c.msgReader, nil
+}
+
+// readDataHeader reads the header of the first frame of the next data message.
+func (c *Conn) readDataHeader(ctx context.Context) (header, error) {
 	h, err := c.readLoop(ctx)
 	if err != nil {
-		return 0, nil, err
+		return header{}, err
 	}
 
 	if h.opcode == opContinuation {
 		err := errors.New("received continuation frame without text or binary frame")
 		c.writeError(StatusProtocolError, err)
-		return 0, nil, err
+		return header{}, err
 	}
-
-	c.msgReader.reset(ctx, h)
-
-	return MessageType(h.opcode), c.msgReader, nil
+	return h, nil
 }
 
 type msgReader struct {
@@ -339,6 +654,11 @@ type msgReader struct {
 	fin           bool
 	payloadLength int64
 	maskKey       uint32
+	fragments     int
+
+	// bytesRead is the number of bytes of the message read so far
+	// for OnReadProgress.
+	bytesRead int64
 
 	// readerFunc(mr.Read) to avoid continuous allocations.
 	readFunc readerFunc
@@ -348,6 +668,8 @@ func (mr *msgReader) reset(ctx context.Context, h header) {
 	mr.ctx = ctx
 	mr.flate = h.rsv1
 	mr.limitReader.reset(mr.readFunc)
+	mr.fragments = 1
+	mr.bytesRead = 0
 
 	if mr.flate {
 		mr.resetFlate()
@@ -356,6 +678,11 @@ func (mr *msgReader) reset(ctx context.Context, h header) {
 	mr.setFrame(h)
 }
 
+// inProgress reports whether a message has been started but not read to EOF.
+func (mr *msgReader) inProgress() bool {
+	return !mr.fin || mr.payloadLength > 0 || mr.flateReader != nil
+}
+
 func (mr *msgReader) setFrame(h header) {
 	mr.fin = h.fin
 	mr.payloadLength = h.payloadLength
@@ -363,9 +690,19 @@ func (mr *msgReader) setFrame(h header) {
 }
 
 func (mr *msgReader) Read(p []byte) (n int, err error) {
+	// Deferred first so that it runs after readMu is unlocked.
+	defer func() {
+		if n > 0 && mr.c.onReadProgress != nil {
+			mr.bytesRead += int64(n)
+			mr.c.onReadProgress(mr.bytesRead)
+		}
+	}()
+
 	err = mr.c.readMu.lock(mr.ctx)
 	if err != nil {
-		return 0, fmt.Errorf("failed to read: %w", err)
+		err = fmt.Errorf("failed to read: %w", err)
+		mr.c.close(err)
+		return 0, err
 	}
 	defer mr.c.readMu.unlock()
 
@@ -394,6 +731,10 @@ func (mr *msgReader) read(p []byte) (int, error) {
 				}
 				return 0, io.EOF
 			}
+			if mr.flate && mr.c.deflateFrame() && mr.flateTail.Len() > 0 {
+				// Every frame ends on a flush with x-webkit-deflate-frame.
+				return mr.flateTail.Read(p)
+			}
 
 			h, err := mr.c.readLoop(mr.ctx)
 			if err != nil {
@@ -404,6 +745,22 @@ func (mr *msgReader) read(p []byte) (int, error) {
 				mr.c.writeError(StatusProtocolError, err)
 				return 0, err
 			}
+			mr.fragments++
+			if mr.c.maxFragments > 0 && mr.fragments > mr.c.maxFragments {
+				err := fmt.Errorf("received message with more than %v fragments", mr.c.maxFragments)
+				mr.c.writeError(StatusProtocolError, err)
+				return 0, err
+			}
+			if mr.c.deflateFrame() {
+				// x-webkit-deflate-frame allows this but the message is
+				// inflated as a single stream. See AllowLegacyDeflateFrame.
+				if h.rsv1 != mr.flate {
+					err := errors.New("received message mixing compressed and uncompressed frames")
+					mr.c.writeError(StatusProtocolError, err)
+					return 0, err
+				}
+				mr.flateTail.Reset(deflateMessageTail)
+			}
 			mr.setFrame(h)
 
 			continue
@@ -432,7 +789,10 @@ type limitReader struct {
 	c     *Conn
 	r     io.Reader
 	limit xsync.Int64
-	n     int64
+
+	// max is the limit for the current message.
+	max int64
+	n   int64
 }
 
 func newLimitReader(c *Conn, r io.Reader, limit int64) *limitReader {
@@ -445,13 +805,20 @@ func newLimitReader(c *Conn, r io.Reader, limit int64) *limitReader {
 }
 
 func (lr *limitReader) reset(r io.Reader) {
-	lr.n = lr.limit.Load()
+	lr.max = lr.limit.Load()
+	// We add read one more byte than the limit in case
+	// there is a fin frame that needs to be read.
+	lr.n = lr.max + 1
 	lr.r = r
 }
 
 func (lr *limitReader) Read(p []byte) (int, error) {
+	if lr.max < 0 {
+		return lr.r.Read(p)
+	}
+
 	if lr.n <= 0 {
-		err := fmt.Errorf("read limited at %v bytes", lr.limit.Load())
+		err := fmt.Errorf("read limited at %v bytes: %w", lr.max, ErrReadLimitExceeded)
 		lr.c.writeError(StatusMessageTooBig, err)
 		return 0, err
 	}
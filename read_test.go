@@ -0,0 +1,387 @@
+// +build !js
+
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket/internal/test/assert"
+	"nhooyr.io/websocket/internal/test/xrand"
+)
+
+// rawPeer is the client end of a connection to a server *Conn that
+// reads and writes raw frames.
+type rawPeer struct {
+	t  testing.TB
+	nc net.Conn
+	br *bufio.Reader
+	bw *bufio.Writer
+}
+
+func newRawPeer(t testing.TB, copts *compressionOptions) (*rawPeer, *Conn) {
+	serverConn, clientConn := net.Pipe()
+	c := newConn(connConfig{
+		rwc:     serverConn,
+		netConn: serverConn,
+		copts:   copts,
+		br:      bufio.NewReader(serverConn),
+		bw:      bufio.NewWriter(serverConn),
+	})
+	rp := &rawPeer{
+		t:  t,
+		nc: clientConn,
+		br: bufio.NewReader(clientConn),
+		bw: bufio.NewWriter(clientConn),
+	}
+	return rp, c
+}
+
+func (rp *rawPeer) writeFrame(h header, p []byte) {
+	rp.t.Helper()
+
+	h.payloadLength = int64(len(p))
+	h.masked = true
+	h.maskKey = 0xdeadbeef
+
+	err := writeFrameHeader(h, rp.bw, make([]byte, 8))
+	assert.Success(rp.t, err)
+
+	p = append([]byte(nil), p...)
+	mask(h.maskKey, p)
+	_, err = rp.bw.Write(p)
+	assert.Success(rp.t, err)
+	err = rp.bw.Flush()
+	assert.Success(rp.t, err)
+}
+
+func (rp *rawPeer) readFrame() (header, []byte) {
+	rp.t.Helper()
+
+	h, err := readFrameHeader(rp.br, make([]byte, 8))
+	assert.Success(rp.t, err)
+	p := make([]byte, h.payloadLength)
+	_, err = io.ReadFull(rp.br, p)
+	assert.Success(rp.t, err)
+	return h, p
+}
+
+func TestReadRSV(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		name   string
+		copts  *compressionOptions
+		header header
+		err    string
+	}{
+		{
+			name: "rsv1NoCompression",
+			header: header{
+				fin:    true,
+				rsv1:   true,
+				opcode: opText,
+			},
+			err: "received frame with RSV1 bit set but permessage-deflate was not negotiated",
+		},
+		{
+			name:  "rsv1Control",
+			copts: &compressionOptions{},
+			header: header{
+				fin:    true,
+				rsv1:   true,
+				opcode: opPing,
+			},
+			err: "received opPing frame with RSV1 bit set",
+		},
+		{
+			name:  "rsv2",
+			copts: &compressionOptions{},
+			header: header{
+				fin:    true,
+				rsv2:   true,
+				opcode: opText,
+			},
+			err: "received frame with unexpected RSV2 bit set",
+		},
+		{
+			name: "rsv3",
+			header: header{
+				fin:    true,
+				rsv3:   true,
+				opcode: opBinary,
+			},
+			err: "received frame with unexpected RSV3 bit set",
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+			defer cancel()
+
+			rp, c := newRawPeer(t, tc.copts)
+			defer c.Close(StatusInternalError, "")
+
+			go rp.writeFrame(tc.header, []byte("hi"))
+
+			errc := make(chan error, 1)
+			go func() {
+				_, _, err := c.Read(ctx)
+				errc <- err
+			}()
+
+			h, p := rp.readFrame()
+			assert.Equal(t, "opcode", opClose, h.opcode)
+			assert.Equal(t, "close code", StatusProtocolError, StatusCode(binary.BigEndian.Uint16(p)))
+			assert.Equal(t, "close reason", tc.err, string(p[2:]))
+			rp.nc.Close()
+
+			assert.Contains(t, <-errc, tc.err)
+		})
+	}
+}
+
+func TestReadInterleavedPing(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	rp, c := newRawPeer(t, nil)
+	defer c.Close(StatusInternalError, "")
+	defer rp.nc.Close()
+
+	go rp.writeFrame(header{opcode: opBinary}, []byte("hello"))
+
+	typ, r, err := c.Reader(ctx)
+	assert.Success(t, err)
+	assert.Equal(t, "type", MessageBinary, typ)
+
+	p := make([]byte, 5)
+	_, err = io.ReadFull(r, p)
+	assert.Success(t, err)
+	assert.Equal(t, "first fragment", "hello", string(p))
+
+	rerr := make(chan error, 1)
+	go func() {
+		b, err := ioutil.ReadAll(r)
+		if err == nil && string(b) != " world" {
+			err = fmt.Errorf("unexpected second fragment: %q", b)
+		}
+		rerr <- err
+	}()
+
+	go rp.writeFrame(header{fin: true, opcode: opPing}, []byte("ping"))
+
+	// The pong is written while the data message is still being read.
+	h, b := rp.readFrame()
+	assert.Equal(t, "opcode", opPong, h.opcode)
+	assert.Equal(t, "payload", "ping", string(b))
+
+	go rp.writeFrame(header{fin: true, opcode: opContinuation}, []byte(" world"))
+	assert.Success(t, <-rerr)
+}
+
+func TestDeflateFrame(t *testing.T) {
+	t.Parallel()
+
+	copts := &compressionOptions{
+		clientNoContextTakeover: true,
+		serverNoContextTakeover: true,
+		deflateFrame:            true,
+	}
+
+	t.Run("read", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+
+		rp, c := newRawPeer(t, copts)
+		defer c.Close(StatusInternalError, "")
+		defer rp.nc.Close()
+
+		fragments := []string{strings.Repeat("hello ", 100), strings.Repeat("world ", 100)}
+		go func() {
+			b := &bytes.Buffer{}
+			fw, err := flate.NewWriter(b, flate.BestSpeed)
+			assert.Success(t, err)
+			for i, f := range fragments {
+				_, err = fw.Write([]byte(f))
+				assert.Success(t, err)
+				err = fw.Flush()
+				assert.Success(t, err)
+
+				h := header{
+					fin:    i == len(fragments)-1,
+					rsv1:   true,
+					opcode: opContinuation,
+				}
+				if i == 0 {
+					h.opcode = opText
+				}
+				rp.writeFrame(h, bytes.TrimSuffix(b.Bytes(), []byte(deflateMessageTail)))
+				b.Reset()
+			}
+		}()
+
+		typ, p, err := c.Read(ctx)
+		assert.Success(t, err)
+		assert.Equal(t, "type", MessageText, typ)
+		assert.Equal(t, "msg", strings.Join(fragments, ""), string(p))
+	})
+
+	t.Run("write", func(t *testing.T) {
+		t.Parallel()
+
+		testDeflateFrameWrite(t, copts, false)
+	})
+
+	t.Run("write/contextTakeover", func(t *testing.T) {
+		t.Parallel()
+
+		testDeflateFrameWrite(t, &compressionOptions{deflateFrame: true}, true)
+	})
+}
+
+func testDeflateFrameWrite(t *testing.T, copts *compressionOptions, contextTakeover bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	rp, c := newRawPeer(t, copts)
+	defer c.Close(StatusInternalError, "")
+	defer rp.nc.Close()
+
+	// The fragments repeat so that later frames would refer back to
+	// earlier ones if context takeover allows it.
+	f := xrand.String(1024)
+	fragments := []string{f, f, f}
+	werr := make(chan error, 1)
+	go func() {
+		w, err := c.Writer(ctx, MessageText)
+		if err != nil {
+			werr <- err
+			return
+		}
+		for _, f := range fragments {
+			_, err = w.Write([]byte(f))
+			if err != nil {
+				werr <- err
+				return
+			}
+		}
+		werr <- w.Close()
+	}()
+
+	// Every fragment is compressed into a frame of its own that inflates
+	// once the tail is appended. With context takeover the previous
+	// fragments are the dictionary, without it every frame stands alone.
+	fr := flate.NewReader(io.MultiReader())
+	defer fr.Close()
+	var dict []byte
+	for i, f := range fragments {
+		h, b := rp.readFrame()
+		assert.Equal(t, "fin", false, h.fin)
+		assert.Equal(t, "rsv1", true, h.rsv1)
+		expOpcode := opContinuation
+		if i == 0 {
+			expOpcode = opText
+		}
+		assert.Equal(t, "opcode", expOpcode, h.opcode)
+
+		err := fr.(flate.Resetter).Reset(io.MultiReader(bytes.NewReader(b), strings.NewReader(deflateMessageTail)), dict)
+		assert.Success(t, err)
+		p := make([]byte, len(f))
+		_, err = io.ReadFull(fr, p)
+		assert.Success(t, err)
+		assert.Equal(t, "fragment", f, string(p))
+		if contextTakeover {
+			dict = append(dict, p...)
+		}
+	}
+
+	h, _ := rp.readFrame()
+	assert.Equal(t, "fin", true, h.fin)
+	assert.Equal(t, "rsv1", true, h.rsv1)
+	assert.Equal(t, "opcode", opContinuation, h.opcode)
+	assert.Success(t, <-werr)
+}
+
+func TestReadLimitInflate(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	rp, c := newRawPeer(t, &compressionOptions{
+		clientNoContextTakeover: true,
+		serverNoContextTakeover: true,
+	})
+	defer c.Close(StatusInternalError, "")
+	defer rp.nc.Close()
+	c.SetReadLimit(1024)
+
+	// 16 MiB of zeroes deflates to a few KiB.
+	b := &bytes.Buffer{}
+	fw, err := flate.NewWriter(b, flate.BestCompression)
+	assert.Success(t, err)
+	_, err = fw.Write(make([]byte, 16<<20))
+	assert.Success(t, err)
+	err = fw.Flush()
+	assert.Success(t, err)
+	p := bytes.TrimSuffix(b.Bytes(), []byte(deflateMessageTail))
+
+	// The conn stops reading part way through the frame so errors
+	// writing the rest of it are expected.
+	go func() {
+		h := header{
+			fin:           true,
+			rsv1:          true,
+			opcode:        opBinary,
+			payloadLength: int64(len(p)),
+			masked:        true,
+			maskKey:       0xdeadbeef,
+		}
+		err := writeFrameHeader(h, rp.bw, make([]byte, 8))
+		if err != nil {
+			return
+		}
+		p := append([]byte(nil), p...)
+		mask(h.maskKey, p)
+		rp.bw.Write(p)
+		rp.bw.Flush()
+	}()
+
+	closeCode := make(chan StatusCode, 1)
+	go func() {
+		h, p := rp.readFrame()
+		if h.opcode != opClose {
+			closeCode <- -1
+			return
+		}
+		ce, _ := parseClosePayload(p)
+		closeCode <- ce.Code
+	}()
+
+	_, _, err = c.Read(ctx)
+	assert.Contains(t, err, ErrReadLimitExceeded.Error())
+	if c.msgReader.payloadLength < int64(len(p))/2 {
+		t.Fatalf("inflated too much of the frame before stopping: %v of %v bytes unread", c.msgReader.payloadLength, len(p))
+	}
+
+	assert.Equal(t, "close code", StatusMessageTooBig, <-closeCode)
+}
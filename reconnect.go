@@ -0,0 +1,324 @@
+package websocket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ReconnectState is the state of a ReconnectingConn as reported to
+// ReconnectOptions.OnStateChange.
+type ReconnectState int
+
+// ReconnectState constants.
+const (
+	// ReconnectConnecting is reported when the connection has failed and
+	// is being re-dialed.
+	ReconnectConnecting ReconnectState = iota + 1
+	// ReconnectConnected is reported once a new connection is established
+	// and OnConnect succeeded.
+	ReconnectConnected
+	// ReconnectClosed is reported when the ReconnectingConn is closed or
+	// gives up after MaxAttempts.
+	ReconnectClosed
+)
+
+func (s ReconnectState) String() string {
+	switch s {
+	case ReconnectConnecting:
+		return "ReconnectConnecting"
+	case ReconnectConnected:
+		return "ReconnectConnected"
+	case ReconnectClosed:
+		return "ReconnectClosed"
+	default:
+		return fmt.Sprintf("ReconnectState(%d)", int(s))
+	}
+}
+
+// ReconnectOptions represents DialReconnecting's options.
+type ReconnectOptions struct {
+	// DialOptions is passed to every Dial.
+	DialOptions *DialOptions
+
+	// OnConnect is called with every new connection before it is used for
+	// reads and writes, e.g. to authenticate or re-subscribe. If it returns an
+	// error, the connection is closed and the dial is retried as if it failed.
+	OnConnect func(ctx context.Context, c *Conn) error
+
+	// OnStateChange is called whenever the state changes. err is the error
+	// that caused the change if any. The first connection made by
+	// DialReconnecting is not reported.
+	OnStateChange func(state ReconnectState, err error)
+
+	// MinBackoff and MaxBackoff bound the exponential backoff between dial
+	// attempts. The wait starts at MinBackoff and doubles after every failed
+	// attempt up to MaxBackoff. Each wait is jittered to between half and the
+	// full backoff so that many clients do not reconnect in lockstep.
+	//
+	// They default to 100ms and 30s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// MaxAttempts is the number of consecutive failed dial attempts after
+	// which the ReconnectingConn gives up and every read and write returns the
+	// last dial error.
+	//
+	// Defaults to 0 which means the ReconnectingConn never gives up.
+	MaxAttempts int
+}
+
+// ReconnectingConn is a client connection that re-dials whenever the
+// underlying connection fails or is closed by the server.
+//
+// Read and Write block while reconnecting until either a new connection is
+// established or their context is done. A Read or Write that fails because
+// the connection failed is retried on the new connection. A retried Write
+// may have been delivered on the failed connection already so messages must
+// be safe to receive more than once.
+//
+// It is safe to call Read and Write concurrently with each other.
+type ReconnectingConn struct {
+	url  string
+	opts ReconnectOptions
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu sync.Mutex
+	// c is nil while reconnecting.
+	c *Conn
+	// ready is closed once c is set or err is set.
+	ready chan struct{}
+	// err is set once closed or given up.
+	err error
+}
+
+// DialReconnecting dials u and returns a ReconnectingConn that re-dials u
+// with the same options whenever the connection fails.
+//
+// The first dial is not retried, an error from it or from OnConnect is
+// returned directly. ctx only bounds the first dial.
+func DialReconnecting(ctx context.Context, u string, opts *ReconnectOptions) (*ReconnectingConn, error) {
+	if opts == nil {
+		opts = &ReconnectOptions{}
+	}
+
+	rc := &ReconnectingConn{
+		url:   u,
+		opts:  *opts,
+		ready: make(chan struct{}),
+	}
+	if rc.opts.MinBackoff <= 0 {
+		rc.opts.MinBackoff = time.Millisecond * 100
+	}
+	if rc.opts.MaxBackoff <= 0 {
+		rc.opts.MaxBackoff = time.Second * 30
+	}
+	if rc.opts.MaxBackoff < rc.opts.MinBackoff {
+		rc.opts.MaxBackoff = rc.opts.MinBackoff
+	}
+
+	c, err := rc.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rc.ctx, rc.cancel = context.WithCancel(context.Background())
+	rc.c = c
+	close(rc.ready)
+	return rc, nil
+}
+
+func (rc *ReconnectingConn) dial(ctx context.Context) (*Conn, error) {
+	c, _, err := Dial(ctx, rc.url, rc.opts.DialOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	if rc.opts.OnConnect != nil {
+		err = rc.opts.OnConnect(ctx, c)
+		if err != nil {
+			c.Close(StatusInternalError, "")
+			return nil, fmt.Errorf("failed to set up connection: %w", err)
+		}
+	}
+
+	return c, nil
+}
+
+// conn returns the current connection, waiting for a reconnect if
+// one is in progress.
+func (rc *ReconnectingConn) conn(ctx context.Context) (*Conn, error) {
+	for {
+		rc.mu.Lock()
+		c, ready, err := rc.c, rc.ready, rc.err
+		rc.mu.Unlock()
+
+		if err != nil {
+			return nil, err
+		}
+		if c != nil {
+			return c, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ready:
+		}
+	}
+}
+
+// failed starts reconnecting if c is still the current connection and has
+// been closed. It reports whether the operation on c should be retried.
+func (rc *ReconnectingConn) failed(c *Conn, err error) bool {
+	if c.Context().Err() == nil {
+		// The connection is still usable so the error was not a failure
+		// of the connection, e.g. ErrWriteQueueFull.
+		return false
+	}
+
+	rc.mu.Lock()
+	if rc.err != nil {
+		rc.mu.Unlock()
+		return false
+	}
+	if rc.c == c {
+		rc.c = nil
+		rc.ready = make(chan struct{})
+		rc.mu.Unlock()
+
+		rc.stateChange(ReconnectConnecting, err)
+		go rc.reconnect()
+		return true
+	}
+	rc.mu.Unlock()
+	return true
+}
+
+func (rc *ReconnectingConn) reconnect() {
+	backoff := rc.opts.MinBackoff
+	for attempt := 1; ; attempt++ {
+		d := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		t := time.NewTimer(d)
+		select {
+		case <-rc.ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+
+		c, err := rc.dial(rc.ctx)
+		if err == nil {
+			// Reported before c is used so that it always precedes the
+			// ReconnectClosed from a later Close.
+			rc.stateChange(ReconnectConnected, nil)
+
+			rc.mu.Lock()
+			if rc.err != nil {
+				rc.mu.Unlock()
+				c.Close(StatusNormalClosure, "")
+				return
+			}
+			rc.c = c
+			close(rc.ready)
+			rc.mu.Unlock()
+			return
+		}
+
+		if rc.opts.MaxAttempts > 0 && attempt >= rc.opts.MaxAttempts {
+			err = fmt.Errorf("failed to reconnect after %v attempts: %w", attempt, err)
+			if _, ok := rc.setErr(err); ok {
+				rc.stateChange(ReconnectClosed, err)
+			}
+			return
+		}
+
+		backoff *= 2
+		if backoff > rc.opts.MaxBackoff {
+			backoff = rc.opts.MaxBackoff
+		}
+	}
+}
+
+// setErr sets the permanent error and wakes up all waiting reads and writes.
+// It returns the current connection and reports whether err was set.
+func (rc *ReconnectingConn) setErr(err error) (*Conn, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.err != nil {
+		return nil, false
+	}
+	if rc.c == nil {
+		close(rc.ready)
+	}
+	rc.err = err
+	return rc.c, true
+}
+
+func (rc *ReconnectingConn) stateChange(state ReconnectState, err error) {
+	if rc.opts.OnStateChange != nil {
+		rc.opts.OnStateChange(state, err)
+	}
+}
+
+// Read reads the next data message, reconnecting as needed.
+// See Conn.Read.
+func (rc *ReconnectingConn) Read(ctx context.Context) (MessageType, []byte, error) {
+	for {
+		c, err := rc.conn(ctx)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to read: %w", err)
+		}
+
+		typ, p, err := c.Read(ctx)
+		if err == nil {
+			return typ, p, nil
+		}
+		if !rc.failed(c, err) || ctx.Err() != nil {
+			return 0, nil, err
+		}
+	}
+}
+
+// Write writes a data message, reconnecting as needed.
+// See Conn.Write.
+func (rc *ReconnectingConn) Write(ctx context.Context, typ MessageType, p []byte) error {
+	for {
+		c, err := rc.conn(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to write: %w", err)
+		}
+
+		err = c.Write(ctx, typ, p)
+		if err == nil {
+			return nil
+		}
+		if !rc.failed(c, err) || ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+// Close stops reconnecting and closes the current connection, if any, with
+// the given status code and reason. See Conn.Close.
+//
+// Reads and writes after Close return an error.
+func (rc *ReconnectingConn) Close(code StatusCode, reason string) error {
+	c, ok := rc.setErr(errors.New("ReconnectingConn closed"))
+	if !ok {
+		return errors.New("ReconnectingConn already closed")
+	}
+	rc.cancel()
+	rc.stateChange(ReconnectClosed, nil)
+
+	if c == nil {
+		return nil
+	}
+	return c.Close(code, reason)
+}
@@ -4,17 +4,19 @@ package websocket
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"time"
 
 	"github.com/klauspost/compress/flate"
 
+	"nhooyr.io/websocket/internal/bpool"
 	"nhooyr.io/websocket/internal/errd"
+	"nhooyr.io/websocket/internal/xsync"
 )
 
 // Writer returns a writer bounded by the context that will write
@@ -38,7 +40,21 @@ func (c *Conn) Writer(ctx context.Context, typ MessageType) (io.WriteCloser, err
 //
 // If compression is disabled or the threshold is not met, then it
 // will write the message in a single frame.
+//
+// If the WriteQueueSize option is set, Write only enqueues the message.
+// See the option's docs.
+//
+// If the write fails because the peer closed the connection, the error
+// carries the peer's close status. See CloseStatus and CloseReason.
 func (c *Conn) Write(ctx context.Context, typ MessageType, p []byte) error {
+	if c.writeQueue != nil {
+		err := c.enqueueWrite(ctx, typ, p)
+		if err != nil {
+			return fmt.Errorf("failed to write msg: %w", err)
+		}
+		return nil
+	}
+
 	_, err := c.write(ctx, typ, p)
 	if err != nil {
 		return fmt.Errorf("failed to write msg: %w", err)
@@ -46,6 +62,157 @@ func (c *Conn) Write(ctx context.Context, typ MessageType, p []byte) error {
 	return nil
 }
 
+// WriteFrom writes the contents of r as a single message, streaming it with
+// Writer instead of buffering all of it, and returns the number of bytes of
+// the message written. The message is fragmented into frames of up to 32 KiB
+// as they are read from r.
+//
+// ctx bounds the writes and is checked before every read from r.
+// If reading from r fails before anything has been written, the message is
+// abandoned and the connection remains usable. Otherwise the message cannot be
+// completed and the connection is closed with StatusInternalError.
+func (c *Conn) WriteFrom(ctx context.Context, typ MessageType, r io.Reader) (_ int64, err error) {
+	defer errd.Wrap(&err, "failed to write msg from reader")
+
+	w, err := c.writer(ctx, typ)
+	if err != nil {
+		return 0, err
+	}
+
+	src := &writeFromReader{ctx: ctx, r: r}
+	n, err := io.CopyBuffer(w, src, make([]byte, writeFromFrameSize))
+	if src.err != nil {
+		err = fmt.Errorf("failed to read msg: %w", src.err)
+		if n > 0 {
+			c.writeError(StatusInternalError, err)
+		}
+		c.msgWriterState.mu.unlock()
+		return n, err
+	}
+	if err != nil {
+		// Either nothing was written and the message can be abandoned
+		// or the connection has been closed.
+		c.msgWriterState.mu.unlock()
+		return n, err
+	}
+
+	return n, w.Close()
+}
+
+const writeFromFrameSize = 32768
+
+// writeFromReader records errors reading from r to tell them apart from
+// write errors. It also hides any WriteTo method of r so that io.CopyBuffer
+// writes the message in frames of the buffer size.
+type writeFromReader struct {
+	ctx context.Context
+	r   io.Reader
+	err error
+}
+
+func (r *writeFromReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		r.err = err
+		return 0, err
+	}
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// ErrWriteQueueFull is returned by Write when the WriteQueueSize option
+// is set and the queue is full.
+var ErrWriteQueueFull = errors.New("write queue full")
+
+type queuedMsg struct {
+	typ MessageType
+	p   []byte
+
+	// flushed is set instead of a message by flushWriteQueue and closed
+	// once every message queued before it has been written.
+	flushed chan struct{}
+}
+
+func (c *Conn) enqueueWrite(ctx context.Context, typ MessageType, p []byte) error {
+	select {
+	case <-c.closed:
+		return c.closeErr
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+
+	m := queuedMsg{
+		typ: typ,
+		p:   append([]byte(nil), p...),
+	}
+	select {
+	case c.writeQueue <- m:
+		return nil
+	default:
+		return ErrWriteQueueFull
+	}
+}
+
+func (c *Conn) writeQueueLoop() {
+	for {
+		select {
+		case <-c.closed:
+			return
+		case m := <-c.writeQueue:
+			if m.flushed != nil {
+				close(m.flushed)
+				continue
+			}
+			// The connection being closed unblocks the write.
+			_, err := c.write(context.Background(), m.typ, m.p)
+			if err != nil {
+				c.close(fmt.Errorf("failed to write queued msg: %w", err))
+				return
+			}
+		}
+	}
+}
+
+// flushWriteQueue waits for the messages queued so far to be written.
+func (c *Conn) flushWriteQueue(ctx context.Context) error {
+	if c.writeQueue == nil {
+		return nil
+	}
+
+	flushed := make(chan struct{})
+	select {
+	case <-c.closed:
+		return c.closeErr
+	case <-ctx.Done():
+		return ctx.Err()
+	case c.writeQueue <- queuedMsg{flushed: flushed}:
+	}
+
+	select {
+	case <-c.closed:
+		return c.closeErr
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-flushed:
+		return nil
+	}
+}
+
+// dropWriteQueue removes the messages still queued so that they are never
+// written. A message writeQueueLoop is already writing is not affected.
+func (c *Conn) dropWriteQueue() {
+	for {
+		select {
+		case <-c.writeQueue:
+		default:
+			return
+		}
+	}
+}
+
 type msgWriter struct {
 	mw     *msgWriterState
 	closed bool
@@ -78,6 +245,14 @@ type msgWriterState struct {
 
 	trimWriter *trimLastFourBytesWriter
 	dict       slidingWindow
+	resetDict  xsync.Int64
+
+	// typ, written and wire describe the message being written for
+	// OnWriteProgress and OnMessageWritten. written counts the bytes of
+	// the message and wire the payload bytes of its frames.
+	typ     MessageType
+	written int64
+	wire    int64
 }
 
 func newMsgWriterState(c *Conn) *msgWriterState {
@@ -96,10 +271,35 @@ func (mw *msgWriterState) ensureFlate() {
 		}
 	}
 
-	mw.dict.init(8192)
+	if mw.resetDict.Load() == 1 {
+		mw.resetDict.Store(0)
+		mw.dict.close()
+		if mw.flateContextTakeover() {
+			// The peer's window still holds the history of the stream, not
+			// the seed, so the window must start empty rather than reseeded.
+			mw.dict.init(8192, nil)
+		}
+	}
+	mw.dict.init(8192, mw.c.compressionDict)
 	mw.flate = true
 }
 
+// ResetCompressionDict discards the compression dictionary so that the next
+// compressed message written is compressed independently of previous ones, as if
+// no context takeover had been negotiated for it. Later messages once again
+// use context takeover.
+//
+// It takes effect at the start of the next compressed message, never in the middle
+// of one. It only affects messages written as the dictionary for messages read must
+// always match the peer's. It is a no-op if compression is disabled or context takeover
+// was not negotiated.
+//
+// The message after a reset is not compressed against CompressionDictionary either
+// as the peer's window holds the previous messages rather than the dictionary.
+func (c *Conn) ResetCompressionDict() {
+	c.msgWriterState.resetDict.Store(1)
+}
+
 func (mw *msgWriterState) flateContextTakeover() bool {
 	if mw.c.client {
 		return !mw.c.copts.clientNoContextTakeover
@@ -125,12 +325,33 @@ func (c *Conn) write(ctx context.Context, typ MessageType, p []byte) (int, error
 	}
 
 	if !c.flate() {
-		defer c.msgWriterState.mu.unlock()
-		return c.writeFrame(ctx, true, false, c.msgWriterState.opcode, p)
+		n, err := c.writeFrame(ctx, true, false, c.msgWriterState.opcode, p)
+		c.msgWriterState.wire += int64(n)
+		c.msgWriterState.progress(n)
+		if err != nil {
+			c.msgWriterState.mu.unlock()
+			return n, err
+		}
+		c.msgWriterState.done()
+		return n, nil
+	}
+
+	if c.compressionFallback && len(p) >= c.flateThreshold {
+		n, err := c.msgWriterState.writeCompressedOrFallback(p)
+		c.msgWriterState.progress(n)
+		if err != nil {
+			c.msgWriterState.mu.unlock()
+			return n, err
+		}
+		c.msgWriterState.done()
+		return n, nil
 	}
 
 	n, err := mw.Write(p)
 	if err != nil {
+		// Either nothing was written and the message can be abandoned
+		// or the connection has been closed.
+		c.msgWriterState.mu.unlock()
 		return n, err
 	}
 
@@ -147,6 +368,9 @@ func (mw *msgWriterState) reset(ctx context.Context, typ MessageType) error {
 	mw.ctx = ctx
 	mw.opcode = opcode(typ)
 	mw.flate = false
+	mw.typ = typ
+	mw.written = 0
+	mw.wire = 0
 
 	mw.trimWriter.reset()
 
@@ -154,7 +378,12 @@ func (mw *msgWriterState) reset(ctx context.Context, typ MessageType) error {
 }
 
 // Write writes the given bytes to the WebSocket connection.
-func (mw *msgWriterState) Write(p []byte) (_ int, err error) {
+func (mw *msgWriterState) Write(p []byte) (n int, err error) {
+	// Deferred first so that it runs after writeMu is unlocked.
+	defer func() {
+		mw.progress(n)
+	}()
+
 	err = mw.writeMu.lock(mw.ctx)
 	if err != nil {
 		return 0, fmt.Errorf("failed to write: %w", err)
@@ -164,7 +393,10 @@ func (mw *msgWriterState) Write(p []byte) (_ int, err error) {
 	defer func() {
 		if err != nil {
 			err = fmt.Errorf("failed to write: %w", err)
-			mw.c.close(err)
+			if mw.flate {
+				// The deflate stream cannot be recovered.
+				mw.c.close(err)
+			}
 		}
 	}()
 
@@ -176,6 +408,10 @@ func (mw *msgWriterState) Write(p []byte) (_ int, err error) {
 		}
 	}
 
+	if mw.flate && mw.c.deflateFrame() {
+		return mw.writeDeflateFrame(p)
+	}
+
 	if mw.flate {
 		err = flate.StatelessDeflate(mw.trimWriter, p, false, mw.dict.buf)
 		if err != nil {
@@ -188,10 +424,108 @@ func (mw *msgWriterState) Write(p []byte) (_ int, err error) {
 	return mw.write(p)
 }
 
+// progress records n more bytes of the message written and reports
+// them to OnWriteProgress.
+func (mw *msgWriterState) progress(n int) {
+	if n <= 0 {
+		return
+	}
+	mw.written += int64(n)
+	if mw.c.onWriteProgress != nil {
+		mw.c.onWriteProgress(mw.written)
+	}
+}
+
+// done unlocks the message writer once the fin frame of the message has
+// been written and reports the message to OnMessageWritten.
+func (mw *msgWriterState) done() {
+	typ, written, wire := mw.typ, mw.written, mw.wire
+	mw.mu.unlock()
+	if mw.c.onMessageWritten != nil {
+		mw.c.onMessageWritten(typ, int(written), int(wire))
+	}
+}
+
+// writeDeflateFrame compresses p into a frame of its own as every frame
+// must end on a flush with x-webkit-deflate-frame.
+func (mw *msgWriterState) writeDeflateFrame(p []byte) (int, error) {
+	b := bpool.Get()
+	defer bpool.Put(b)
+
+	dict := mw.dict.buf
+	if !mw.flateContextTakeover() && mw.opcode == opContinuation {
+		// Without context takeover, every frame is compressed independently
+		// of the previous frames, not just of the previous messages.
+		dict = nil
+	}
+
+	err := flate.StatelessDeflate(b, p, false, dict)
+	if err != nil {
+		return 0, fmt.Errorf("failed to compress: %w", err)
+	}
+
+	_, err = mw.write(bytes.TrimSuffix(b.Bytes(), []byte(deflateMessageTail)))
+	if err != nil {
+		return 0, err
+	}
+	if mw.flateContextTakeover() {
+		mw.dict.write(p)
+	}
+	return len(p), nil
+}
+
+// writeCompressedOrFallback writes p as a single frame, compressed unless
+// compression would not make it smaller.
+func (mw *msgWriterState) writeCompressedOrFallback(p []byte) (_ int, err error) {
+	err = mw.writeMu.lock(mw.ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to write: %w", err)
+	}
+	defer mw.writeMu.unlock()
+
+	mw.ensureFlate()
+	defer func() {
+		if !mw.flateContextTakeover() {
+			mw.dict.close()
+		}
+	}()
+
+	b := bpool.Get()
+	defer bpool.Put(b)
+
+	err = flate.StatelessDeflate(b, p, false, mw.dict.buf)
+	if err != nil {
+		return 0, fmt.Errorf("failed to compress: %w", err)
+	}
+	// Like trimLastFourBytesWriter, the tail is implied by the fin bit.
+	compressed := bytes.TrimSuffix(b.Bytes(), []byte(deflateMessageTail))
+
+	if len(compressed) >= len(p) {
+		// Uncompressed messages are not part of the peer's window
+		// so the dictionary is left untouched.
+		mw.flate = false
+		mw.c.compressionFallbacks.Store(mw.c.compressionFallbacks.Load() + 1)
+		n, err := mw.c.writeFrame(mw.ctx, true, false, mw.opcode, p)
+		mw.wire += int64(n)
+		return n, err
+	}
+
+	n, err := mw.c.writeFrame(mw.ctx, true, true, mw.opcode, compressed)
+	mw.wire += int64(n)
+	if err != nil {
+		return 0, err
+	}
+	mw.dict.write(p)
+	return len(p), nil
+}
+
 func (mw *msgWriterState) write(p []byte) (int, error) {
 	n, err := mw.c.writeFrame(mw.ctx, false, mw.flate, mw.opcode, p)
+	mw.wire += int64(n)
 	if err != nil {
-		return n, fmt.Errorf("failed to write data frame: %w", err)
+		err = fmt.Errorf("failed to write data frame: %w", err)
+		mw.failed(err)
+		return n, err
 	}
 	mw.opcode = opContinuation
 	return n, nil
@@ -201,6 +535,14 @@ func (mw *msgWriterState) write(p []byte) (int, error) {
 func (mw *msgWriterState) Close() (err error) {
 	defer errd.Wrap(&err, "failed to close writer")
 
+	// Deferred first so that OnMessageWritten is called after writeMu is unlocked.
+	var finished bool
+	defer func() {
+		if finished {
+			mw.done()
+		}
+	}()
+
 	err = mw.writeMu.lock(mw.ctx)
 	if err != nil {
 		return err
@@ -209,16 +551,33 @@ func (mw *msgWriterState) Close() (err error) {
 
 	_, err = mw.c.writeFrame(mw.ctx, true, mw.flate, mw.opcode, nil)
 	if err != nil {
-		return fmt.Errorf("failed to write fin frame: %w", err)
+		err = fmt.Errorf("failed to write fin frame: %w", err)
+		if !mw.failed(err) {
+			// Nothing of the message was written so it is abandoned.
+			mw.mu.unlock()
+		}
+		return err
 	}
 
 	if mw.flate && !mw.flateContextTakeover() {
 		mw.dict.close()
 	}
-	mw.mu.unlock()
+	finished = true
 	return nil
 }
 
+// failed is called when writing a frame of the message failed and reports
+// whether the failure is fatal. writeFrame only leaves the connection open
+// if it did not start writing the frame but if previous frames of the message
+// were written, the connection must still be closed as the message cannot be
+// finished.
+func (mw *msgWriterState) failed(err error) bool {
+	if mw.opcode == opContinuation {
+		mw.c.close(err)
+	}
+	return mw.c.isClosed()
+}
+
 func (mw *msgWriterState) close() {
 	if mw.c.client {
 		mw.c.writeFrameMu.forceLock()
@@ -229,18 +588,109 @@ func (mw *msgWriterState) close() {
 	mw.dict.close()
 }
 
+// writeControl writes a control frame within the close handshake timeout or
+// the deadline of ctx, whichever comes first.
 func (c *Conn) writeControl(ctx context.Context, opcode opcode, p []byte) error {
-	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	// Nothing has been written yet so the connection remains usable.
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("failed to write control frame %v: %w", opcode, err)
+	}
+
+	ctx, cancel := c.withCloseHandshakeTimeout(ctx)
 	defer cancel()
 
 	_, err := c.writeFrame(ctx, true, false, opcode, p)
 	if err != nil {
-		return fmt.Errorf("failed to write control frame %v: %w", opcode, err)
+		err = fmt.Errorf("failed to write control frame %v: %w", opcode, err)
+		c.close(err)
+		return err
+	}
+	return nil
+}
+
+// WriteRawFrame writes a single frame with the header hdr exactly as given
+// followed by payload, bypassing all validation. It is meant for protocol
+// conformance testing of peers, e.g. sending reserved opcodes, fragmented
+// control frames or length fields that disagree with the payload, and will
+// readily violate the protocol. Do not use it otherwise.
+//
+// hdr.PayloadLength is written as is and is not derived from payload. If
+// hdr.Masked is set, payload is masked with hdr.MaskKey. Conn does not track
+// raw frames so writing one in the middle of a message or writing a close
+// frame does not change its state.
+//
+// As with other writes, any error once the frame has been started closes
+// the connection.
+func (c *Conn) WriteRawFrame(ctx context.Context, hdr FrameHeader, payload []byte) (err error) {
+	defer errd.Wrap(&err, "failed to write raw frame")
+
+	if hdr.Opcode < 0 || hdr.Opcode > 0xf {
+		return fmt.Errorf("opcode %v does not fit in 4 bits", hdr.Opcode)
+	}
+
+	err = c.writeFrameMu.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.writeFrameMu.unlock()
+
+	select {
+	case <-c.closed:
+		return c.closeErr
+	case c.writeTimeout <- ctx:
+	}
+
+	defer func() {
+		if err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			c.close(err)
+		}
+	}()
+
+	h := header{
+		fin:           hdr.Fin,
+		rsv1:          hdr.RSV1,
+		rsv2:          hdr.RSV2,
+		rsv3:          hdr.RSV3,
+		opcode:        opcode(hdr.Opcode),
+		payloadLength: hdr.PayloadLength,
+		masked:        hdr.Masked,
+		maskKey:       hdr.MaskKey,
+	}
+	err = writeFrameHeader(h, c.bw, c.writeHeaderBuf[:])
+	if err != nil {
+		return err
+	}
+
+	if h.masked {
+		payload = append([]byte(nil), payload...)
+		mask(h.maskKey, payload)
+	}
+	_, err = c.bw.Write(payload)
+	if err != nil {
+		return fmt.Errorf("failed to write frame payload: %w", err)
+	}
+	err = c.bw.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to flush: %w", err)
+	}
+
+	select {
+	case <-c.closed:
+		return c.closeErr
+	case c.writeTimeout <- context.Background():
 	}
+
 	return nil
 }
 
 // frame handles all writes to the connection.
+//
+// Errors before the frame header is written, such as the context expiring while
+// waiting for the frame lock, leave the connection usable. Once the frame has been
+// started, any error closes the connection as a partial frame cannot be recovered from.
 func (c *Conn) writeFrame(ctx context.Context, fin bool, flate bool, opcode opcode, p []byte) (_ int, err error) {
 	err = c.writeFrameMu.lock(ctx)
 	if err != nil {
@@ -265,6 +715,11 @@ func (c *Conn) writeFrame(ctx context.Context, fin bool, flate bool, opcode opco
 		}
 	}
 
+	// Nothing has been written yet so the connection remains usable.
+	if ctx.Err() != nil {
+		return 0, fmt.Errorf("failed to write frame: %w", ctx.Err())
+	}
+
 	select {
 	case <-c.closed:
 		return 0, c.closeErr
@@ -273,11 +728,17 @@ func (c *Conn) writeFrame(ctx context.Context, fin bool, flate bool, opcode opco
 
 	defer func() {
 		if err != nil {
-			select {
-			case <-c.closed:
-				err = c.closeErr
-			case <-ctx.Done():
+			// A partially written frame cannot be recovered from so the connection
+			// is always closed. We prefer the context's error so that callers can
+			// distinguish their cancellation from a transport failure.
+			if ctx.Err() != nil {
 				err = ctx.Err()
+			} else {
+				select {
+				case <-c.closed:
+					err = c.closeErr
+				default:
+				}
 			}
 			c.close(err)
 			err = fmt.Errorf("failed to write frame: %w", err)
@@ -288,7 +749,7 @@ func (c *Conn) writeFrame(ctx context.Context, fin bool, flate bool, opcode opco
 	c.writeHeader.opcode = opcode
 	c.writeHeader.payloadLength = int64(len(p))
 
-	if c.client {
+	if c.client && !c.disableMasking {
 		c.writeHeader.masked = true
 		_, err = io.ReadFull(rand.Reader, c.writeHeaderBuf[:4])
 		if err != nil {
@@ -298,7 +759,7 @@ func (c *Conn) writeFrame(ctx context.Context, fin bool, flate bool, opcode opco
 	}
 
 	c.writeHeader.rsv1 = false
-	if flate && (opcode == opText || opcode == opBinary) {
+	if flate && (opcode == opText || opcode == opBinary || opcode == opContinuation && c.deflateFrame()) {
 		c.writeHeader.rsv1 = true
 	}
 
@@ -335,6 +796,10 @@ func (c *Conn) writeFramePayload(p []byte) (n int, err error) {
 		return c.bw.Write(p)
 	}
 
+	// The payload is masked in place in the write buffer. This holds even when
+	// the buffer is smaller than the frame header as the header may have been
+	// flushed across multiple writes but Buffered always gives the offset at
+	// which the next payload byte will be written.
 	maskKey := c.writeHeader.maskKey
 	for len(p) > 0 {
 		// If the buffer is full, we need to flush.
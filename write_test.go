@@ -0,0 +1,136 @@
+// +build !js
+
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket/internal/test/assert"
+)
+
+func TestWriteControl(t *testing.T) {
+	t.Parallel()
+
+	t.Run("cancelled", func(t *testing.T) {
+		t.Parallel()
+
+		rp, c := newRawPeer(t, nil)
+		defer c.Close(StatusInternalError, "")
+		defer rp.nc.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := c.writeControl(ctx, opPing, []byte("hi"))
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context.Canceled but got %v", err)
+		}
+		// Nothing was written so the connection is still usable.
+		assert.Equal(t, "closed", false, c.isClosed())
+
+		go func() {
+			err := c.writeControl(context.Background(), opPing, []byte("hi"))
+			assert.Success(t, err)
+		}()
+		h, p := rp.readFrame()
+		assert.Equal(t, "opcode", opPing, h.opcode)
+		assert.Equal(t, "payload", "hi", string(p))
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		t.Parallel()
+
+		rp, c := newRawPeer(t, nil)
+		defer c.Close(StatusInternalError, "")
+		defer rp.nc.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		// The peer never reads so the write only returns when ctx's
+		// deadline is hit, well before the close handshake timeout.
+		start := time.Now()
+		err := c.writeControl(ctx, opPing, []byte("hi"))
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected context.DeadlineExceeded but got %v", err)
+		}
+		if d := time.Since(start); d >= defaultCloseHandshakeTimeout {
+			t.Fatalf("write took %v", d)
+		}
+	})
+}
+
+func TestWriteRawFrame(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	rp, c := newRawPeer(t, nil)
+	defer c.Close(StatusInternalError, "")
+	defer rp.nc.Close()
+
+	// A fragmented ping with a reserved bit set masked by the server,
+	// none of which writeFrame would ever produce.
+	hdr := FrameHeader{
+		RSV2:          true,
+		Opcode:        int(opPing),
+		PayloadLength: 5,
+		Masked:        true,
+		MaskKey:       0xcafebabe,
+	}
+	werr := make(chan error, 1)
+	go func() {
+		werr <- c.WriteRawFrame(ctx, hdr, []byte("hello"))
+	}()
+
+	h, p := rp.readFrame()
+	assert.Success(t, <-werr)
+	assert.Equal(t, "header", hdr, h.export())
+	mask(h.maskKey, p)
+	assert.Equal(t, "payload", "hello", string(p))
+
+	err := c.WriteRawFrame(ctx, FrameHeader{Opcode: 16}, nil)
+	assert.Contains(t, err, "does not fit in 4 bits")
+	assert.Equal(t, "closed", false, c.isClosed())
+}
+
+func TestDisableMasking(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	serverConn, clientConn := net.Pipe()
+	c := newConn(connConfig{
+		rwc:            clientConn,
+		netConn:        clientConn,
+		client:         true,
+		disableMasking: true,
+		br:             bufio.NewReader(clientConn),
+		bw:             bufio.NewWriter(clientConn),
+	})
+	defer c.Close(StatusInternalError, "")
+	defer serverConn.Close()
+
+	werr := make(chan error, 1)
+	go func() {
+		werr <- c.Write(ctx, MessageText, []byte("hello"))
+	}()
+
+	br := bufio.NewReader(serverConn)
+	h, err := readFrameHeader(br, make([]byte, 8))
+	assert.Success(t, err)
+	assert.Equal(t, "masked", false, h.masked)
+	p := make([]byte, h.payloadLength)
+	_, err = io.ReadFull(br, p)
+	assert.Success(t, err)
+	assert.Equal(t, "payload", "hello", string(p))
+	assert.Success(t, <-werr)
+}
@@ -8,12 +8,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"reflect"
 	"runtime"
 	"strings"
 	"sync"
 	"syscall/js"
+	"time"
 
 	"nhooyr.io/websocket/internal/bpool"
 	"nhooyr.io/websocket/internal/wsjs"
@@ -35,6 +37,10 @@ type Conn struct {
 	closeErr      error
 	closeWasClean bool
 
+	// ctx is returned by Context and cancelled with closeErr on close.
+	ctx       context.Context
+	cancelCtx func(error)
+
 	releaseOnClose   func()
 	releaseOnMessage func()
 
@@ -53,11 +59,13 @@ func (c *Conn) close(err error, wasClean bool) {
 		c.setCloseErr(err)
 		c.closeWasClean = wasClean
 		close(c.closed)
+		c.cancelCtx(c.closeErr)
 	})
 }
 
 func (c *Conn) init() {
 	c.closed = make(chan struct{})
+	c.ctx, c.cancelCtx = withCancelCause(context.Background())
 	c.readSignal = make(chan struct{}, 1)
 
 	c.msgReadLimit.Store(32768)
@@ -110,14 +118,99 @@ func (c *Conn) Read(ctx context.Context) (MessageType, []byte, error) {
 	if err != nil {
 		return 0, nil, fmt.Errorf("failed to read: %w", err)
 	}
-	if int64(len(p)) > c.msgReadLimit.Load() {
-		err := fmt.Errorf("read limited at %v bytes", c.msgReadLimit.Load())
+	if limit := c.msgReadLimit.Load(); limit >= 0 && int64(len(p)) > limit {
+		err := fmt.Errorf("read limited at %v bytes: %w", limit, ErrReadLimitExceeded)
 		c.Close(StatusMessageTooBig, err.Error())
-		return 0, nil, err
+		return typ, p[:limit], err
 	}
 	return typ, p, nil
 }
 
+// ReadInto is like Read but copies the message into buf.
+// If the message does not fit, buf is filled with the start of the
+// message and a BufferTooSmallError is returned.
+func (c *Conn) ReadInto(ctx context.Context, buf []byte) (MessageType, int, error) {
+	typ, p, err := c.Read(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	n := copy(buf, p)
+	if n < len(p) {
+		return typ, n, BufferTooSmallError{
+			Size: int64(len(p)),
+		}
+	}
+	return typ, n, nil
+}
+
+// PeekMessage implements *Conn.PeekMessage for wasm.
+// As the browser delivers entire messages, the message is always buffered.
+func (c *Conn) PeekMessage(ctx context.Context, n int) (MessageType, []byte, io.Reader, error) {
+	if n < 0 {
+		return 0, nil, nil, fmt.Errorf("failed to peek message: negative length %v", n)
+	}
+	typ, p, err := c.Read(ctx)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if n > len(p) {
+		n = len(p)
+	}
+	return typ, p[:n], bytes.NewReader(p[n:]), nil
+}
+
+// WriteFrom implements *Conn.WriteFrom for wasm.
+// As the browser only accepts entire messages, r is read fully first.
+func (c *Conn) WriteFrom(ctx context.Context, typ MessageType, r io.Reader) (int64, error) {
+	p, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, fmt.Errorf("failed to write msg from reader: failed to read msg: %w", err)
+	}
+	err = c.Write(ctx, typ, p)
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(p)), nil
+}
+
+// NextMessageType implements *Conn.NextMessageType for wasm.
+func (c *Conn) NextMessageType(ctx context.Context) (MessageType, error) {
+	select {
+	case <-ctx.Done():
+		c.Close(StatusPolicyViolation, "read timed out")
+		return 0, fmt.Errorf("failed to get next message type: %w", ctx.Err())
+	case <-c.readSignal:
+	case <-c.closed:
+		return 0, fmt.Errorf("failed to get next message type: %w", c.closeErr)
+	}
+
+	c.readBufMu.Lock()
+	me := c.readBuf[0]
+	c.readBufMu.Unlock()
+
+	// The message is left for the next read to take.
+	select {
+	case c.readSignal <- struct{}{}:
+	default:
+	}
+
+	if _, ok := me.Data.(string); ok {
+		return MessageText, nil
+	}
+	return MessageBinary, nil
+}
+
+// SkipMessage implements *Conn.SkipMessage for wasm.
+// As PeekMessage has already consumed the entire message, the next message
+// is always skipped.
+func (c *Conn) SkipMessage(ctx context.Context) error {
+	_, _, err := c.Read(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to skip message: %w", err)
+	}
+	return nil
+}
+
 func (c *Conn) read(ctx context.Context) (MessageType, []byte, error) {
 	select {
 	case <-ctx.Done():
@@ -160,6 +253,37 @@ func (c *Conn) Ping(ctx context.Context) error {
 	return nil
 }
 
+// ResetCompressionDict is a no-op for Wasm as the browser handles compression.
+func (c *Conn) ResetCompressionDict() {
+}
+
+// SetPingHandler is mocked out for Wasm.
+// The handler is never called as browsers do not expose pings.
+func (c *Conn) SetPingHandler(fn func(ctx context.Context, payload []byte) error) {
+}
+
+// ConnStats holds statistics about a connection.
+type ConnStats struct {
+	CompressionFallbacks int64
+}
+
+// Stats is mocked out for Wasm.
+// It always returns zero statistics as the browser handles compression.
+func (c *Conn) Stats() ConnStats {
+	return ConnStats{}
+}
+
+// LastRTT is mocked out for Wasm.
+// It always returns zero as browsers do not expose pings.
+func (c *Conn) LastRTT() time.Duration {
+	return 0
+}
+
+// SetPongHandler is mocked out for Wasm.
+// The handler is never called as browsers do not expose pongs.
+func (c *Conn) SetPongHandler(fn func(payload []byte, rtt time.Duration)) {
+}
+
 // Write writes a message of the given type to the connection.
 // Always non blocking.
 func (c *Conn) Write(ctx context.Context, typ MessageType, p []byte) error {
@@ -235,6 +359,12 @@ func (c *Conn) Subprotocol() string {
 	return c.ws.Subprotocol()
 }
 
+// NegotiatedExtensions returns the extensions selected by the server.
+// An empty string means no extensions.
+func (c *Conn) NegotiatedExtensions() string {
+	return c.ws.Extensions()
+}
+
 // DialOptions represents the options available to pass to Dial.
 type DialOptions struct {
 	// Subprotocols lists the subprotocols to negotiate with the server.
@@ -362,9 +492,17 @@ func (c *Conn) CloseRead(ctx context.Context) context.Context {
 
 // SetReadLimit implements *Conn.SetReadLimit for wasm.
 func (c *Conn) SetReadLimit(n int64) {
+	if n < 0 {
+		n = -1
+	}
 	c.msgReadLimit.Store(n)
 }
 
+// ReadLimit implements *Conn.ReadLimit for wasm.
+func (c *Conn) ReadLimit() int64 {
+	return c.msgReadLimit.Load()
+}
+
 func (c *Conn) setCloseErr(err error) {
 	c.closeErrOnce.Do(func() {
 		c.closeErr = fmt.Errorf("WebSocket closed: %w", err)
@@ -65,3 +65,42 @@ func write(ctx context.Context, c *websocket.Conn, v interface{}) (err error) {
 
 	return w.Close()
 }
+
+// Result is a JSON message read by Stream.
+type Result struct {
+	// Msg is the raw JSON message. It is owned by the receiver.
+	Msg json.RawMessage
+	// Err is the error that stopped the stream.
+	// It is only set on the last Result sent.
+	Err error
+}
+
+// Stream reads JSON messages from c in a new goroutine and sends each
+// on the returned channel, leaving it to the caller to decode them.
+//
+// The stream stops on the first error, including the connection being closed,
+// which is sent as the last Result before the channel is closed.
+//
+// The caller must either receive until the channel is closed or cancel
+// ctx to stop the goroutine.
+func Stream(ctx context.Context, c *websocket.Conn) <-chan Result {
+	resc := make(chan Result)
+	go func() {
+		defer close(resc)
+
+		for {
+			var res Result
+			res.Err = read(ctx, c, &res.Msg)
+
+			select {
+			case resc <- res:
+			case <-ctx.Done():
+				return
+			}
+			if res.Err != nil {
+				return
+			}
+		}
+	}()
+	return resc
+}
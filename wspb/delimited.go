@@ -0,0 +1,184 @@
+package wspb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/golang/protobuf/proto"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/internal/bpool"
+	"nhooyr.io/websocket/internal/errd"
+)
+
+// DelimitedWriter writes a stream of protobuf messages into a single
+// binary WebSocket message. Each protobuf message is prefixed with its
+// varint encoded length, the same framing used by writeDelimitedTo in
+// the other protobuf implementations.
+//
+// Only one protobuf message is marshalled at a time so the WebSocket
+// message may be arbitrarily large.
+type DelimitedWriter struct {
+	c  *websocket.Conn
+	w  io.WriteCloser
+	pb *proto.Buffer
+}
+
+// NewDelimitedWriter starts a binary message on c for DelimitedWriter.Write.
+// The message is sent once Close is called.
+func NewDelimitedWriter(ctx context.Context, c *websocket.Conn) (*DelimitedWriter, error) {
+	w, err := c.Writer(ctx, websocket.MessageBinary)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write delimited protobuf message: %w", err)
+	}
+	return &DelimitedWriter{
+		c:  c,
+		w:  w,
+		pb: proto.NewBuffer(bpool.Get().Bytes()),
+	}, nil
+}
+
+// Write writes the length delimited protobuf message v.
+//
+// A WebSocket message that has been started cannot be abandoned, so if v
+// fails to marshal the connection is closed with StatusInternalError rather
+// than leaving every other write on it blocked.
+func (w *DelimitedWriter) Write(v proto.Message) (err error) {
+	defer errd.Wrap(&err, "failed to write delimited protobuf message")
+
+	if w.pb == nil {
+		return errors.New("cannot use closed writer")
+	}
+
+	w.pb.Reset()
+	err = w.pb.EncodeMessage(v)
+	if err != nil {
+		w.c.Close(websocket.StatusInternalError, "failed to marshal protobuf")
+		return fmt.Errorf("failed to marshal protobuf: %w", err)
+	}
+
+	_, err = w.w.Write(w.pb.Bytes())
+	return err
+}
+
+// Close flushes the WebSocket message.
+func (w *DelimitedWriter) Close() (err error) {
+	defer errd.Wrap(&err, "failed to write delimited protobuf message")
+
+	if w.pb != nil {
+		bpool.Put(bytes.NewBuffer(w.pb.Bytes()[:0]))
+		w.pb = nil
+	}
+	return w.w.Close()
+}
+
+// WriteDelimited writes the protobuf messages vs to c as a single binary
+// message framed as by DelimitedWriter. As with DelimitedWriter.Write, the
+// connection is closed if one of vs fails to marshal.
+func WriteDelimited(ctx context.Context, c *websocket.Conn, vs ...proto.Message) error {
+	w, err := NewDelimitedWriter(ctx, c)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range vs {
+		err = w.Write(v)
+		if err != nil {
+			return err
+		}
+	}
+
+	return w.Close()
+}
+
+// DelimitedReader reads the length delimited protobuf messages
+// written by DelimitedWriter out of a single binary WebSocket message.
+type DelimitedReader struct {
+	c   *websocket.Conn
+	br  *bufio.Reader
+	b   *bytes.Buffer
+	err error
+}
+
+// NewDelimitedReader reads the next WebSocket message from c for
+// DelimitedReader.Read. The message must be binary.
+func NewDelimitedReader(ctx context.Context, c *websocket.Conn) (_ *DelimitedReader, err error) {
+	defer errd.Wrap(&err, "failed to read delimited protobuf message")
+
+	typ, r, err := c.Reader(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if typ != websocket.MessageBinary {
+		c.Close(websocket.StatusUnsupportedData, "expected binary message")
+		return nil, fmt.Errorf("expected binary message for protobuf but got: %v", typ)
+	}
+
+	return &DelimitedReader{
+		c:  c,
+		br: bufio.NewReader(r),
+		b:  bpool.Get(),
+	}, nil
+}
+
+// Read reads the next length delimited protobuf message into v.
+// It returns io.EOF once every protobuf message in the WebSocket
+// message has been read.
+func (r *DelimitedReader) Read(v proto.Message) error {
+	if r.err != nil {
+		return r.err
+	}
+
+	err := r.read(v)
+	if err != nil {
+		if err != io.EOF {
+			err = fmt.Errorf("failed to read delimited protobuf message: %w", err)
+		}
+		r.err = err
+		bpool.Put(r.b)
+		r.b = nil
+	}
+	return err
+}
+
+func (r *DelimitedReader) read(v proto.Message) error {
+	n, err := binary.ReadUvarint(r.br)
+	if err != nil {
+		if err == io.EOF {
+			return io.EOF
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			r.c.Close(websocket.StatusInvalidFramePayloadData, "truncated delimited protobuf")
+		}
+		return fmt.Errorf("failed to read length: %w", err)
+	}
+	if n > math.MaxInt64 {
+		r.c.Close(websocket.StatusInvalidFramePayloadData, "invalid delimited protobuf length")
+		return fmt.Errorf("invalid protobuf length: %v", n)
+	}
+
+	r.b.Reset()
+	_, err = io.CopyN(r.b, r.br, int64(n))
+	if err != nil {
+		if err == io.EOF {
+			r.c.Close(websocket.StatusInvalidFramePayloadData, "truncated delimited protobuf")
+			return fmt.Errorf("truncated protobuf: %w", io.ErrUnexpectedEOF)
+		}
+		return err
+	}
+
+	err = proto.Unmarshal(r.b.Bytes(), v)
+	if err != nil {
+		r.c.Close(websocket.StatusInvalidFramePayloadData, "failed to unmarshal protobuf")
+		return fmt.Errorf("failed to unmarshal protobuf: %w", err)
+	}
+
+	return nil
+}
@@ -1,4 +1,9 @@
 // Package wspb provides helpers for reading and writing protobuf messages.
+//
+// Read and Write handle a single protobuf per WebSocket message. ReadStream
+// and WriteStream do too but stream the message with Conn.Reader and
+// Conn.Writer for large protobufs. To send many protobufs within a single
+// WebSocket message, use DelimitedWriter and DelimitedReader.
 package wspb // import "nhooyr.io/websocket/wspb"
 
 import (
@@ -71,3 +76,56 @@ func write(ctx context.Context, c *websocket.Conn, v proto.Message) (err error)
 
 	return c.Write(ctx, websocket.MessageBinary, pb.Bytes())
 }
+
+// ReadStream is like Read but is meant for large protobuf messages. The
+// message is read with Conn.Reader into a buffer that only grows as the
+// message is read and is not pooled, so a single large message does not
+// remain allocated across calls. The read limit of c still applies.
+//
+// As a protobuf cannot be unmarshalled incrementally, the encoding of v is
+// still held in memory in full once read.
+func ReadStream(ctx context.Context, c *websocket.Conn, v proto.Message) (err error) {
+	defer errd.Wrap(&err, "failed to read protobuf message")
+
+	typ, r, err := c.Reader(ctx)
+	if err != nil {
+		return err
+	}
+
+	if typ != websocket.MessageBinary {
+		c.Close(websocket.StatusUnsupportedData, "expected binary message")
+		return fmt.Errorf("expected binary message for protobuf but got: %v", typ)
+	}
+
+	var b bytes.Buffer
+	_, err = b.ReadFrom(r)
+	if err != nil {
+		return err
+	}
+
+	err = proto.Unmarshal(b.Bytes(), v)
+	if err != nil {
+		c.Close(websocket.StatusInvalidFramePayloadData, "failed to unmarshal protobuf")
+		return fmt.Errorf("failed to unmarshal protobuf: %w", err)
+	}
+
+	return nil
+}
+
+// WriteStream is like Write but is meant for large protobuf messages. The
+// encoding of v is written with Conn.Writer in frames of up to 32 KiB instead
+// of as a single frame, see Conn.WriteFrom, and its buffer is not pooled.
+//
+// As a protobuf cannot be marshalled incrementally, the encoding of v is
+// still held in memory in full while it is written.
+func WriteStream(ctx context.Context, c *websocket.Conn, v proto.Message) (err error) {
+	defer errd.Wrap(&err, "failed to write protobuf message")
+
+	b, err := proto.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal protobuf: %w", err)
+	}
+
+	_, err = c.WriteFrom(ctx, websocket.MessageBinary, bytes.NewReader(b))
+	return err
+}